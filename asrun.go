@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Layout of dates in as-run log file names and in requests.
+const dateLayout = "2006-01-02"
+
+// A record of an item that was played, for music reporting.
+type asRunEntry struct {
+	Start   time.Time
+	End     time.Time
+	Played  int64             // How far into the file playback got, in microseconds like TIME
+	Outcome string            // "played" if it got to the end, "skipped" if not
+	Data    string            // The item's data, as clients know it
+	Path    string            // Where the file actually was
+	Meta    map[string]string `json:",omitempty"`
+}
+
+// Keeps a log of everything played, one file of JSON lines per day.
+type asRunLog struct {
+	dir string
+}
+
+// The file holding the entries for the day containing t.
+func (l *asRunLog) fileFor(t time.Time) string {
+	return filepath.Join(l.dir, "asrun-"+t.Local().Format(dateLayout)+".jsonl")
+}
+
+// Record appends e to the file for the day it started.
+func (l *asRunLog) Record(e asRunEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.fileFor(e.Start), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read gives the entries for the day containing t, oldest first.
+func (l *asRunLog) Read(t time.Time) (entries []asRunEntry, err error) {
+	f, err := os.Open(l.fileFor(t))
+	if os.IsNotExist(err) {
+		return nil, nil // Nothing played that day
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e asRunEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
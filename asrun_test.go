@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAsRunLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &asRunLog{dir: dir}
+
+	today := time.Date(2015, 3, 14, 9, 0, 0, 0, time.Local)
+	yesterday := today.AddDate(0, 0, -1)
+	entries := []asRunEntry{
+		{yesterday, yesterday.Add(3 * time.Minute), 180000000, "played", "library:rasputin.mp3", "/music/rasputin.mp3", map[string]string{"artist": "Boney M."}},
+		{today, today.Add(time.Minute), 60000000, "skipped", "library:mabaker.mp3", "/music/mabaker.mp3", nil},
+		{today.Add(time.Minute), today.Add(4 * time.Minute), 180000000, "played", "/tmp/science.mp3", "/tmp/science.mp3", nil},
+	}
+	for _, e := range entries {
+		if err = l.Record(e); err != nil {
+			t.Fatalf("TestAsRunLog: record returned err (%s)", err.Error())
+		}
+	}
+
+	got, err := l.Read(today.Add(12 * time.Hour))
+	if err != nil {
+		t.Fatalf("TestAsRunLog: read returned err (%s)", err.Error())
+	}
+	if len(got) != 2 {
+		t.Fatalf("TestAsRunLog: read %d entries for today, want 2", len(got))
+	}
+	for i, e := range got {
+		want := entries[i+1]
+		if !e.Start.Equal(want.Start) || !e.End.Equal(want.End) || e.Played != want.Played || e.Outcome != want.Outcome || e.Data != want.Data || e.Path != want.Path || !reflect.DeepEqual(e.Meta, want.Meta) {
+			t.Errorf("TestAsRunLog: entry %d == %v, want %v", i, e, want)
+		}
+	}
+
+	if got, err = l.Read(today.AddDate(0, 0, 1)); err != nil || got != nil {
+		t.Errorf("TestAsRunLog: read of empty day == (%v, %v), want nothing", got, err)
+	}
+}
@@ -35,7 +35,7 @@ func (c *Client) Read(reqCh chan<- clientAndMessage, rmCh chan<- *Client) {
 			continue // TODO: Do something?
 		}
 		for _, line := range lines {
-			msg, err := baps3.LineToMessage(line)
+			msg, err := lineToMessage(line)
 			if err != nil {
 				log.Println(err)
 				continue // TODO: Do something?
@@ -55,7 +55,7 @@ func (c *Client) Write(resCh <-chan baps3.Message, rmCh chan<- *Client) {
 		if !ok {
 			return
 		}
-		data, err := msg.Pack()
+		data, err := packMessage(msg)
 		if err != nil {
 			log.Println(err.Error())
 			continue
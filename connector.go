@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// A connection to the downstream service. Works like baps3-go's Connector, but knows about listd's own
+// words (such as gain and fade) as well as baps3-go's.
+// Requests go down ReqCh, and closing it closes the connection; responses come back on resCh.
+// If the connection is lost any other way, why goes down errCh.
+type connector struct {
+	ReqCh chan baps3.Message
+	resCh chan<- baps3.Message
+	errCh chan<- error
+	conn  net.Conn
+	// Closed once the connector is stopping, so reading gives up on anything not yet taken.
+	done chan struct{}
+	wg   *sync.WaitGroup
+	log  *log.Logger
+}
+
+// Makes a connector sending responses down resCh, and read errors down errCh. wg is done with once Run has finished.
+func initConnector(resCh chan<- baps3.Message, errCh chan<- error, wg *sync.WaitGroup, logger *log.Logger) *connector {
+	wg.Add(1)
+	return &connector{
+		ReqCh: make(chan baps3.Message),
+		resCh: resCh,
+		errCh: errCh,
+		done:  make(chan struct{}),
+		wg:    wg,
+		log:   logger,
+	}
+}
+
+// Connects to the downstream service at addr (host:port).
+func (c *connector) Connect(addr string) (err error) {
+	c.conn, err = net.Dial("tcp", addr)
+	return
+}
+
+// Sends requests until ReqCh is closed, reading responses meanwhile.
+func (c *connector) Run() {
+	defer c.wg.Done()
+	go c.read()
+	for req := range c.ReqCh {
+		data, err := packMessage(req)
+		if err != nil {
+			c.log.Println(err.Error())
+			continue
+		}
+		if _, err := c.conn.Write(data); err != nil {
+			c.log.Println("Error writing:", err.Error())
+		}
+	}
+	close(c.done) // First, so reading knows the error closing causes is expected
+	c.conn.Close()
+}
+
+func (c *connector) read() {
+	reader := bufio.NewReader(c.conn)
+	tok := baps3.NewTokeniser()
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil {
+			select {
+			case <-c.done: // Closed on purpose
+			default:
+				c.log.Println("Error reading:", err.Error())
+				select {
+				case c.errCh <- err:
+				case <-c.done:
+				}
+			}
+			return
+		}
+		lines, _, err := tok.Tokenise(data)
+		if err != nil {
+			c.log.Println(err)
+			continue
+		}
+		for _, line := range lines {
+			msg, err := lineToMessage(line)
+			if err != nil {
+				c.log.Println(err)
+				continue
+			}
+			select {
+			case c.resCh <- *msg:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
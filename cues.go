@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Gives a duration in microseconds, like TIME.
+func microsStr(d time.Duration) string {
+	return strconv.FormatInt(d.Nanoseconds()/1000, 10)
+}
+
+func makeRsCue(i int, item *PlaylistItem, name string) *baps3.Message {
+	return baps3.NewMessage(RsCue).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(name).AddArg(microsStr(*item.Cue(name)))
+}
+
+// Whether the downstream service has said it can do ft.
+func (h *hub) downstreamHas(ft baps3.Feature) bool {
+	_, ok := h.downstreamState.Features[ft]
+	return ok
+}
+
+// Sets or clears a cue point. Takes the index, hash, cue point name and offset in microseconds (0 to clear).
+func (h *hub) processReqCue(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 4 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, name, atStr := args[0], args[1], args[2], args[3]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+	us, err := strconv.ParseInt(atStr, 10, 64)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad time"))
+	}
+
+	curIdx, _, err := pl.SetCue(i, hash, name, time.Duration(us)*time.Microsecond)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, makeRsCue(curIdx, pl.items[curIdx], name))
+}
+
+// Sends the downstream service to the selected item's cue in, if it has one, after loading it.
+func (h *hub) seekToCueIn() {
+	if sel := h.pl.Selected(); sel != nil && sel.CueIn > 0 && h.downstreamHas(baps3.FtSeek) {
+		h.cReqCh <- *baps3.NewMessage(baps3.RqSeek).AddArg(microsStr(sel.CueIn))
+	}
+}
+
+// Follows the selected item's progress through its cue points, once the downstream state has a new TIME.
+// Counts down through the intro and outro, and stops playback at the cue out as if the item had ended,
+// telling clients it was cued out.
+func (h *hub) handleTime() {
+	sel := h.pl.Selected()
+	if sel == nil {
+		return
+	}
+	pos := h.downstreamState.Time
+	if h.cuedOut == sel.Hash && pos < sel.CueOut {
+		h.cuedOut = "" // Back before the cue out, so it can stop there again
+	}
+	if h.downstreamState.State != baps3.StPlaying {
+		return
+	}
+	i := h.pl.selection
+
+	if sel.IntroEnd > pos {
+		h.broadcast(*baps3.NewMessage(RsIntro).AddArg(strconv.Itoa(i)).AddArg(sel.Hash).AddArg(microsStr(sel.IntroEnd - pos)))
+	}
+	end := sel.End()
+	if sel.OutroStart > 0 && sel.OutroStart <= pos && pos < end {
+		h.broadcast(*baps3.NewMessage(RsOutro).AddArg(strconv.Itoa(i)).AddArg(sel.Hash).AddArg(microsStr(end - pos)))
+	}
+
+	if sel.CueOut > 0 && pos >= sel.CueOut && h.cuedOut != sel.Hash {
+		h.cuedOut = sel.Hash // TIMEs past the cue out can keep arriving until playd has stopped, or even after reloading
+		h.cReqCh <- *baps3.NewMessage(baps3.RqStop)
+		h.broadcast(*baps3.NewMessage(RsCuedOut).AddArg(strconv.Itoa(i)).AddArg(sel.Hash))
+		h.handleRsEnd(*baps3.NewMessage(baps3.RsEnd))
+	}
+}
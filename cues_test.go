@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestHandleTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type step struct {
+		state       baps3.State
+		pos         time.Duration
+		wantSent    []string
+		wantCuedOut bool
+	}
+	cases := []struct {
+		autoAdvance bool
+		repeatMode  RepeatMode
+		steps       []step
+	}{
+		{false, RepeatNone, []step{
+			{baps3.StPlaying, time.Minute, nil, false},
+			{baps3.StPlaying, 3 * time.Minute, []string{"stop"}, true},
+			// Test TIMEs from before playd stopped
+			{baps3.StPlaying, 3*time.Minute + time.Second, nil, false},
+			{baps3.StStopped, 3*time.Minute + time.Second, nil, false},
+			// Test seeking back, which lets it stop at the cue out again
+			{baps3.StStopped, 2 * time.Minute, nil, false},
+			{baps3.StPlaying, 3 * time.Minute, []string{"stop"}, true},
+		}},
+		// Test repeating, where the item's reloaded straight away, and stale TIMEs mustn't stop it again
+		{true, RepeatOne, []step{
+			{baps3.StPlaying, 3 * time.Minute, []string{"stop", "load", "play"}, true},
+			{baps3.StPlaying, 3*time.Minute + time.Second, nil, false},
+			{baps3.StPlaying, 0, nil, false},
+			{baps3.StPlaying, 3 * time.Minute, []string{"stop", "load", "play"}, true},
+		}},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile, CueOut: 3 * time.Minute},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		}
+		h, reqCh := newTestHub(t, dir, items, 0)
+		h.autoAdvance, h.repeatMode = c.autoAdvance, c.repeatMode
+		resCh := addTestClient(h)
+
+		for stepno, s := range c.steps {
+			h.downstreamState.State, h.downstreamState.Time = s.state, s.pos
+			h.handleTime()
+			if sent := sentWords(reqCh); !reflect.DeepEqual(sent, s.wantSent) {
+				t.Errorf("TestHandleTime: case %d step %d sent %v, want %v", caseno, stepno, sent, s.wantSent)
+			}
+			cuedOut := false
+			for _, word := range sentWords(resCh) {
+				cuedOut = cuedOut || word == "CUEDOUT"
+			}
+			if cuedOut != s.wantCuedOut {
+				t.Errorf("TestHandleTime: case %d step %d told clients cued out %v, want %v", caseno, stepno, cuedOut, s.wantCuedOut)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func (h *hub) makeRsAlarm() *baps3.Message {
+	msg := baps3.NewMessage(RsAlarm)
+	if h.alarm != "" {
+		msg.AddArg(h.alarm)
+	}
+	return msg
+}
+
+// Notes that the downstream service has just said it's playing.
+// It only counts as playing while it keeps saying so, so a dead service doesn't look like it's still going.
+func (h *hub) notePlaying(now time.Time) {
+	if h.downstreamState.State == baps3.StPlaying {
+		h.lastPlaying = now
+		h.held = false
+	}
+}
+
+// Notes that nothing's playing on purpose: the operator stopped, paused or ejected, a stop-after item
+// halted things, or the running order ran out. That silence isn't dead air, so doesn't count towards
+// falling back, until something plays again.
+func (h *hub) noteHeld() {
+	h.held = true
+}
+
+// Falls back if nothing has been heard playing for longer than the silence threshold while auto-advance is on,
+// unless nothing's meant to be playing.
+func (h *hub) checkSilence(now time.Time) {
+	if h.silenceThreshold == 0 || !h.autoAdvance || h.alarm != "" {
+		return
+	}
+	if h.activeLink() != nil || h.held {
+		h.lastPlaying = now // Someone's talking, or it's quiet on purpose
+		return
+	}
+	if now.Sub(h.lastPlaying) <= h.silenceThreshold {
+		return
+	}
+	reason := "Nothing playing"
+	if h.downstreamState.State == baps3.StPlaying {
+		reason = "No word from playd"
+	}
+	h.fallBack(reason)
+}
+
+// Falls back on losing the downstream service, as nothing can play until it's back.
+// Once fallen back, automation's in charge, so losing the backup playd can only be logged.
+func (h *hub) lostDownstream(err error) {
+	if h.alarm != "" {
+		log.Println("Lost playd while fallen back:", err.Error())
+		return
+	}
+	h.fallBack("Lost playd")
+}
+
+// Raises the alarm, and lets automation take over: switching to the backup playd and the fallback playlist,
+// whichever are configured, and playing.
+// The alarm stays raised, and nothing else falls back, until a client clears it.
+func (h *hub) fallBack(reason string) {
+	log.Println("Falling back:", reason)
+	h.alarm = reason
+	h.broadcast(*h.makeRsAlarm())
+	if h.fallbackAddr == "" && h.fallbackPlaylist == "" {
+		return // Nothing to take over with
+	}
+
+	if h.fallbackAddr != "" {
+		log.Println("Switching to backup playd at", h.fallbackAddr)
+		resCh, errCh := make(chan baps3.Message), make(chan error)
+		c := initConnector(resCh, errCh, h.connWG, log.New(os.Stderr, "backup playd:", 0))
+		if err := c.Connect(h.fallbackAddr); err != nil {
+			log.Println("Error connecting to backup playd:", err.Error())
+			c.wg.Done() // Never run
+		} else {
+			go c.Run()
+			close(h.cReqCh) // Done with the old playd
+			h.setConnector(c.ReqCh, resCh, errCh)
+			h.downstreamState = *baps3.InitServiceState()
+			h.awaitingBackup = true
+		}
+		h.fallbackAddr = "" // Nothing to switch to next time
+	}
+
+	if h.fallbackPlaylist != "" {
+		if active, _ := h.pls.Active(); active != h.fallbackPlaylist {
+			if err := h.activatePlaylist(h.fallbackPlaylist); err != nil {
+				log.Println("Error activating fallback playlist:", err.Error())
+			} else {
+				for _, msg := range h.makeActivatedResponses() {
+					h.broadcast(*msg)
+				}
+			}
+		}
+	}
+
+	// Carry on from the selection, if it's still there, otherwise start from the top
+	oldSelected := h.pl.Selected()
+	if !h.pl.HasSelection() {
+		h.pl.Rewind()
+	}
+	h.leaveItem(oldSelected)
+	h.broadcast(*makeRsSelect(h.pl))
+	h.lastPlaying = time.Now()
+	if !h.awaitingBackup {
+		h.playFallback()
+	}
+}
+
+// Loads and plays the selection, if any, once fallen back.
+// On a backup playd, this waits for it to say what it can do, so the selection's cue in and levels are applied.
+func (h *hub) playFallback() {
+	h.awaitingBackup = false
+	h.held = false
+	h.lastPlaying = time.Now() // Give playd a chance to get going
+	if h.pl.HasSelection() && h.loadSelected() {
+		h.cReqCh <- *baps3.NewMessage(baps3.RqPlay)
+	}
+}
+
+// Clears the alarm, once the studio has things back in hand.
+func (h *hub) processReqClearAlarm(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 0 {
+		return makeBadCommandMsgs()
+	}
+	h.alarm = ""
+	h.lastPlaying = time.Now()
+	return append(resps, h.makeRsAlarm())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestCheckSilence(t *testing.T) {
+	now := time.Unix(1000, 0)
+	file := func() *PlaylistItem {
+		return &PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile}
+	}
+	link := &PlaylistItem{Data: "Travel news", Hash: "aaa", Type: ItemLink, State: ItemPlaying, Meta: map[string]string{"duration": "60000000"}}
+
+	cases := []struct {
+		item        *PlaylistItem
+		autoAdvance bool
+		held        bool
+		alarm       string
+		state       baps3.State
+		quietFor    time.Duration
+		want        string
+	}{
+		{file(), true, false, "", baps3.StStopped, 11 * time.Second, "Nothing playing"},
+		{file(), true, false, "", baps3.StPlaying, 11 * time.Second, "No word from playd"},
+		// Test silence under the threshold
+		{file(), true, false, "", baps3.StStopped, 10 * time.Second, ""},
+		// Test silence with auto-advance off, where the operator's in charge
+		{file(), false, false, "", baps3.StStopped, time.Minute, ""},
+		// Test silence the operator asked for, or the running order ended with
+		{file(), true, true, "", baps3.StStopped, time.Minute, ""},
+		{nil, true, true, "", baps3.StEjected, time.Minute, ""},
+		// Test a timed link, where someone's talking
+		{link, true, false, "", baps3.StEjected, time.Minute, ""},
+		// Test an alarm that's already raised
+		{file(), true, false, "Nothing playing", baps3.StStopped, time.Minute, "Nothing playing"},
+	}
+	for caseno, c := range cases {
+		h := &hub{pl: InitPlaylist(), silenceThreshold: 10 * time.Second}
+		if c.item != nil {
+			h.pl = makePlaylist([]*PlaylistItem{c.item}, 0)
+		}
+		h.autoAdvance, h.held, h.alarm = c.autoAdvance, c.held, c.alarm
+		h.downstreamState.State = c.state
+		h.lastPlaying = now.Add(-c.quietFor)
+
+		h.checkSilence(now)
+		if h.alarm != c.want {
+			t.Errorf("TestCheckSilence: case %d raised alarm %q, want %q", caseno, h.alarm, c.want)
+		}
+	}
+}
+
+func TestFallBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		fallbackPlaylist string
+		sel              int
+		wantActive       string
+		wantSel          int
+		wantSent         []string
+	}{
+		// Test nothing to take over with, which just raises the alarm
+		{"", 1, DefaultPlaylistName, 1, nil},
+		// Test switching to the fallback playlist, from the top
+		{"backup", 1, "backup", 0, []string{"eject", "load", "play"}},
+		// Test the fallback playlist being active already, carrying on from the selection if there is one
+		{DefaultPlaylistName, 1, DefaultPlaylistName, 1, []string{"load", "play"}},
+		{DefaultPlaylistName, -1, DefaultPlaylistName, 0, []string{"load", "play"}},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		}
+		h, reqCh := newTestHub(t, dir, items, c.sel)
+		h.pls.Create("backup")
+		h.pls.Get("backup").Enqueue(0, &PlaylistItem{Data: "library:rasputin.mp3", Hash: "ccc", Type: ItemFile})
+		h.downstreamState.State = baps3.StStopped
+		h.fallbackPlaylist = c.fallbackPlaylist
+		h.held = true
+		resCh := addTestClient(h)
+
+		h.fallBack("Nothing playing")
+		if h.alarm != "Nothing playing" {
+			t.Errorf("TestFallBack: case %d raised alarm %q, want %q", caseno, h.alarm, "Nothing playing")
+		}
+		if words := sentWords(resCh); len(words) == 0 || words[0] != "ALARM" {
+			t.Errorf("TestFallBack: case %d told clients %v, want ALARM first", caseno, words)
+		}
+		if active, pl := h.pls.Active(); active != c.wantActive || h.pl != pl {
+			t.Errorf("TestFallBack: case %d left %q active, want %q", caseno, active, c.wantActive)
+		}
+		if h.pl.selection != c.wantSel {
+			t.Errorf("TestFallBack: case %d selected %d, want %d", caseno, h.pl.selection, c.wantSel)
+		}
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestFallBack: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+		if wantHeld := c.wantSent == nil; h.held != wantHeld {
+			t.Errorf("TestFallBack: case %d left held %v, want %v", caseno, h.held, wantHeld)
+		}
+	}
+}
+
+func TestPlayFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A stand-in for the backup playd
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	items := []*PlaylistItem{{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile}}
+	h, reqCh := newTestHub(t, dir, items, 0)
+	h.connWG = new(sync.WaitGroup)
+	h.fallbackAddr = l.Addr().String()
+
+	h.fallBack("No word from playd")
+	if !h.awaitingBackup || h.fallbackAddr != "" {
+		t.Fatalf("TestPlayFallback: didn't switch to the backup playd")
+	}
+	if sent := sentWords(reqCh); sent != nil {
+		t.Errorf("TestPlayFallback: sent %v to the old playd, want nothing", sent)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Once the backup says what it can do
+	h.playFallback()
+	if h.awaitingBackup {
+		t.Errorf("TestPlayFallback: still waiting for the backup playd after playing")
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"load ", "play"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("TestPlayFallback: backup playd got %q, err %v, want %q", line, err, want)
+		}
+		if !strings.HasPrefix(line, want) {
+			t.Errorf("TestPlayFallback: backup playd got %q, want %q", line, want)
+		}
+	}
+	close(h.cReqCh)
+	h.connWG.Wait()
+}
+
+func TestLostDownstream(t *testing.T) {
+	cases := []struct {
+		alarm string
+		want  string
+	}{
+		{"", "Lost playd"},
+		// Test losing the backup playd, once already fallen back
+		{"Nothing playing", "Nothing playing"},
+	}
+	for caseno, c := range cases {
+		h := &hub{pl: InitPlaylist(), alarm: c.alarm}
+		h.lostDownstream(errors.New("EOF"))
+		if h.alarm != c.want {
+			t.Errorf("TestLostDownstream: case %d raised alarm %q, want %q", caseno, h.alarm, c.want)
+		}
+	}
+}
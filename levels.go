@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func gainStr(gain float64) string {
+	return strconv.FormatFloat(gain, 'f', -1, 64)
+}
+
+func makeRsGain(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsGain).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(gainStr(item.Gain))
+}
+
+func makeRsFade(i int, item *PlaylistItem, name string) *baps3.Message {
+	return baps3.NewMessage(RsFade).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(name).AddArg(microsStr(*item.Fade(name)))
+}
+
+// Collates the responses giving item's levels, leaving out those not set.
+func makeLevelResponses(i int, item *PlaylistItem) (msgs []*baps3.Message) {
+	if item.Gain != 0 {
+		msgs = append(msgs, makeRsGain(i, item))
+	}
+	for _, name := range FadeNames {
+		if *item.Fade(name) != 0 {
+			msgs = append(msgs, makeRsFade(i, item, name))
+		}
+	}
+	return
+}
+
+// Sets the gain of an item. Takes the index, hash and gain in dB (0 for none).
+func (h *hub) processReqGain(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 3 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, gainArg := args[0], args[1], args[2]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+	gain, err := strconv.ParseFloat(gainArg, 64)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad gain"))
+	}
+
+	curIdx, _, err := pl.SetGain(i, hash, gain)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	h.updateLevels(pl, curIdx)
+	return append(resps, makeRsGain(curIdx, pl.items[curIdx]))
+}
+
+// Sets or clears a fade. Takes the index, hash, "in" or "out" and length in microseconds (0 to clear).
+func (h *hub) processReqFade(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 4 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, name, lengthStr := args[0], args[1], args[2], args[3]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+	us, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad time"))
+	}
+
+	curIdx, _, err := pl.SetFade(i, hash, name, time.Duration(us)*time.Microsecond)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	h.updateLevels(pl, curIdx)
+	return append(resps, makeRsFade(curIdx, pl.items[curIdx], name))
+}
+
+// Sends the levels of the item at i in pl again if it's the one loaded, so changes to them apply straight away.
+func (h *hub) updateLevels(pl *Playlist, i int) {
+	if pl == h.pl && i == pl.selection {
+		h.sendLevels()
+	}
+}
+
+// Tells the downstream service the selected item's levels, after loading it, if it can apply them.
+// Levels are always sent, even if not set, so they don't carry over from the last item.
+func (h *hub) sendLevels() {
+	sel := h.pl.Selected()
+	if h.downstreamHas(FtGain) {
+		h.cReqCh <- *baps3.NewMessage(RqGain).AddArg(gainStr(sel.Gain))
+	}
+	if h.downstreamHas(FtFade) {
+		for _, name := range FadeNames {
+			h.cReqCh <- *baps3.NewMessage(RqFade).AddArg(name).AddArg(microsStr(*sel.Fade(name)))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestLevelsSentOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gain := func(h *hub, pl *Playlist, hash string) []*baps3.Message {
+		return h.processReqGain(pl, *baps3.NewMessage(RqGain).AddArg(anyIndex).AddArg(hash).AddArg("-3"))
+	}
+	fade := func(h *hub, pl *Playlist, hash string) []*baps3.Message {
+		return h.processReqFade(pl, *baps3.NewMessage(RqFade).AddArg(anyIndex).AddArg(hash).AddArg("in").AddArg("2000000"))
+	}
+	cases := []struct {
+		handler  func(*hub, *Playlist, string) []*baps3.Message
+		active   bool
+		hash     string
+		wantSent []string
+	}{
+		{gain, true, "aaa", []string{"gain", "fade", "fade"}},
+		{fade, true, "aaa", []string{"gain", "fade", "fade"}},
+		// Test items that aren't loaded: unselected, or in another playlist
+		{gain, true, "bbb", nil},
+		{fade, true, "bbb", nil},
+		{gain, false, "aaa", nil},
+		{fade, false, "aaa", nil},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		}
+		h, reqCh := newTestHub(t, dir, items, 0)
+		h.downstreamState.Features = make(baps3.FeatureSet)
+		h.downstreamState.Features.AddFeature(FtGain)
+		h.downstreamState.Features.AddFeature(FtFade)
+		pl := h.pl
+		if !c.active {
+			h.pls.Create("overrun")
+			pl = h.pls.Get("overrun")
+			pl.Enqueue(0, &PlaylistItem{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile})
+			pl.selection = 0
+		}
+
+		c.handler(h, pl, c.hash)
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestLevelsSentOnChange: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+	}
+}
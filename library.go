@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most results a search gives, so a vague query doesn't swamp clients.
+const maxSearchResults = 100
+
+// A file in the media library.
+type libraryEntry struct {
+	Data string            // name:relative/path reference, usable as a file item's data
+	Meta map[string]string // Tags read from the file, as for file items
+
+	// For spotting changes on rescan
+	modTime time.Time
+	size    int64
+}
+
+// Extensions the library indexes when file items can have any, so ffprobe isn't run on everything in the roots.
+var audioExtensions = []string{"mp3", "flac", "ogg", "oga", "opus", "wav", "m4a", "aac", "aif", "aiff", "wma"}
+
+// A directory in the media roots, as it was when last scanned.
+type libraryDir struct {
+	modTime time.Time
+	subdirs []string // Paths
+	files   []string // Data of the files indexed directly inside
+}
+
+// An index of the files in the media roots, kept up to date in the background.
+// Requests are served from the hub loop while the indexer runs in its own goroutine, hence the lock.
+type library struct {
+	ffprobe   string
+	validator *fileValidator
+
+	// Directories as last scanned, by root name then path. Only touched by the indexer.
+	dirs map[string]map[string]*libraryDir
+
+	mu      sync.RWMutex
+	entries map[string]*libraryEntry // Keyed by Data
+}
+
+func newLibrary(ffprobe string, validator *fileValidator) *library {
+	return &library{
+		ffprobe:   ffprobe,
+		validator: validator,
+		dirs:      make(map[string]map[string]*libraryDir),
+		entries:   make(map[string]*libraryEntry),
+	}
+}
+
+// Run scans the media roots now and then every interval, forever.
+// An interval of 0 means scan once only.
+func (l *library) Run(interval time.Duration) {
+	for {
+		for _, r := range l.validator.roots {
+			l.scanRoot(r)
+		}
+		if interval == 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Whether the file at path belongs in the library.
+func (l *library) indexable(path string) bool {
+	if len(l.validator.extensions) == 0 {
+		return containsString(audioExtensions, strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")))
+	}
+	return l.validator.allowedType(path)
+}
+
+// Rescans root, then swaps the results into the index.
+// Only directories that have changed since the last scan (so have had files added, removed or replaced)
+// are listed again, and only files that are new or have changed have their tags read.
+// Files rewritten in place, without being replaced, aren't noticed until their directory next changes.
+func (l *library) scanRoot(root mediaRoot) {
+	prefix := root.name + ":"
+	dirs := make(map[string]*libraryDir)
+	scanned := make(map[string]*libraryEntry)
+	l.scanDir(root, root.dir, l.dirs[root.name], dirs, scanned)
+	l.dirs[root.name] = dirs
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for data := range l.entries {
+		if strings.HasPrefix(data, prefix) {
+			if _, ok := scanned[data]; !ok {
+				delete(l.entries, data) // Gone since last scan
+			}
+		}
+	}
+	for data, e := range scanned {
+		l.entries[data] = e
+	}
+}
+
+// Scans dir and everything under it, recording it in dirs and its files in scanned.
+// old is how the root's directories were last time.
+func (l *library) scanDir(root mediaRoot, dir string, old map[string]*libraryDir, dirs map[string]*libraryDir, scanned map[string]*libraryEntry) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		log.Println("Error scanning", dir, ":", err.Error())
+		return
+	}
+	d, ok := old[dir]
+	if ok && d.modTime.Equal(fi.ModTime()) {
+		l.mu.RLock()
+		for _, data := range d.files {
+			if e, ok := l.entries[data]; ok {
+				scanned[data] = e
+			}
+		}
+		l.mu.RUnlock()
+	} else if d, err = l.readDir(root, dir, fi.ModTime(), scanned); err != nil {
+		log.Println("Error scanning", dir, ":", err.Error())
+		return
+	}
+	dirs[dir] = d
+	for _, sub := range d.subdirs {
+		l.scanDir(root, sub, old, dirs, scanned)
+	}
+}
+
+// Lists dir afresh, only reading tags from files that are new or have changed since the last scan.
+func (l *library) readDir(root mediaRoot, dir string, modTime time.Time, scanned map[string]*libraryEntry) (*libraryDir, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &libraryDir{modTime: modTime}
+	for _, fi := range fis {
+		p := filepath.Join(dir, fi.Name())
+		if fi.IsDir() {
+			d.subdirs = append(d.subdirs, p)
+			continue
+		}
+		if !fi.Mode().IsRegular() || !l.indexable(p) {
+			continue
+		}
+		rel, err := filepath.Rel(root.dir, p)
+		if err != nil {
+			continue
+		}
+		data := root.name + ":" + filepath.ToSlash(rel)
+		d.files = append(d.files, data)
+
+		l.mu.RLock()
+		old, ok := l.entries[data]
+		l.mu.RUnlock()
+		if ok && old.modTime.Equal(fi.ModTime()) && old.size == fi.Size() {
+			scanned[data] = old
+			continue
+		}
+		meta, _ := probeFile(l.ffprobe, p)
+		scanned[data] = &libraryEntry{Data: data, Meta: meta, modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return d, nil
+}
+
+// Search finds files whose reference or tags contain every word of query, ignoring case.
+func (l *library) Search(query string) (results []*libraryEntry) {
+	words := strings.Fields(strings.ToLower(query))
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, e := range l.entries {
+		haystack := strings.ToLower(e.Data)
+		for _, v := range e.Meta {
+			haystack += "\n" + strings.ToLower(v)
+		}
+		matched := true
+		for _, w := range words {
+			if !strings.Contains(haystack, w) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			results = append(results, e)
+		}
+	}
+	sortEntries(results)
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+	return
+}
+
+// Browse lists what's directly inside dir, which is a name:relative/path reference.
+// Subdirectories come back as references ending in /, and sort before files.
+// With an empty dir, lists the media roots themselves.
+func (l *library) Browse(dir string) (dirs []string, files []*libraryEntry, err error) {
+	if dir == "" {
+		for _, r := range l.validator.roots {
+			dirs = append(dirs, r.name+":")
+		}
+		return
+	}
+	pair := strings.SplitN(dir, ":", 2)
+	if len(pair) != 2 {
+		return nil, nil, fmt.Errorf("Not a media root reference")
+	}
+	if _, ok := l.validator.root(pair[0]); !ok {
+		return nil, nil, fmt.Errorf("No such media root")
+	}
+	if !strings.HasSuffix(dir, ":") && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	seen := make(map[string]bool)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for data, e := range l.entries {
+		if !strings.HasPrefix(data, dir) {
+			continue
+		}
+		rest := data[len(dir):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			sub := dir + rest[:i] + "/"
+			if !seen[sub] {
+				seen[sub] = true
+				dirs = append(dirs, sub)
+			}
+		} else {
+			files = append(files, e)
+		}
+	}
+	sort.Strings(dirs)
+	sortEntries(files)
+	return
+}
+
+func sortEntries(entries []*libraryEntry) {
+	sort.Sort(byData(entries))
+}
+
+type byData []*libraryEntry
+
+func (b byData) Len() int           { return len(b) }
+func (b byData) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byData) Less(i, j int) bool { return b[i].Data < b[j].Data }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func entryData(entries []*libraryEntry) (datas []string) {
+	for _, e := range entries {
+		datas = append(datas, e.Data)
+	}
+	return
+}
+
+func TestLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"boney m/rasputin.mp3", "boney m/ma baker.mp3", "dolby/science.mp3", "readme.txt"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte("ra ra"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := newFileValidator([]string{"library=" + dir}, "mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLibrary("/nonexistent/ffprobe", v)
+	l.Run(0)
+
+	searches := []struct {
+		query string
+		want  []string
+	}{
+		{"RASPUTIN", []string{"library:boney m/rasputin.mp3"}},
+		{"boney mp3", []string{"library:boney m/ma baker.mp3", "library:boney m/rasputin.mp3"}},
+		{"readme", nil}, // Not an allowed type
+		{"gaben", nil},
+	}
+	for _, c := range searches {
+		if got := entryData(l.Search(c.query)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("TestLibrary: Search(%q) == %v, want %v", c.query, got, c.want)
+		}
+	}
+
+	browses := []struct {
+		dir       string
+		wantDirs  []string
+		wantFiles []string
+	}{
+		{"", []string{"library:"}, nil},
+		{"library:", []string{"library:boney m/", "library:dolby/"}, nil},
+		{"library:boney m", nil, []string{"library:boney m/ma baker.mp3", "library:boney m/rasputin.mp3"}},
+		{"library:dolby/", nil, []string{"library:dolby/science.mp3"}},
+	}
+	for _, c := range browses {
+		dirs, files, err := l.Browse(c.dir)
+		if err != nil {
+			t.Errorf("TestLibrary: Browse(%q) returned err (%s)", c.dir, err.Error())
+		} else if !reflect.DeepEqual(dirs, c.wantDirs) || !reflect.DeepEqual(entryData(files), c.wantFiles) {
+			t.Errorf("TestLibrary: Browse(%q) == (%v, %v), want (%v, %v)", c.dir, dirs, entryData(files), c.wantDirs, c.wantFiles)
+		}
+	}
+
+	for _, dir := range []string{"library", "jukebox:"} {
+		if _, _, err = l.Browse(dir); err == nil {
+			t.Errorf("TestLibrary: Browse(%q) returned nil when should be err", dir)
+		}
+	}
+
+	// Test rescan picks up additions to unchanged and changed directories
+	added := filepath.Join(dir, "boney m", "daddy cool.mp3")
+	if err = ioutil.WriteFile(added, []byte("ra ra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the directory looks changed, however coarse the filesystem's times
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Dir(added), later, later); err != nil {
+		t.Fatal(err)
+	}
+	l.Run(0)
+	if got, want := entryData(l.Search("boney")), []string{"library:boney m/daddy cool.mp3", "library:boney m/ma baker.mp3", "library:boney m/rasputin.mp3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TestLibrary: Search after addition == %v, want %v", got, want)
+	}
+
+	// Test rescan picks up removals
+	if err = os.RemoveAll(filepath.Join(dir, "dolby")); err != nil {
+		t.Fatal(err)
+	}
+	l.Run(0)
+	if got := entryData(l.Search("science")); got != nil {
+		t.Errorf("TestLibrary: Search after removal == %v, want nothing", got)
+	}
+}
+
+func TestLibraryAnyExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"rasputin.mp3", "readme.txt"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte("ra ra"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := newFileValidator([]string{"library=" + dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLibrary("/nonexistent/ffprobe", v)
+	l.Run(0)
+	_, files, err := l.Browse("library:")
+	if err != nil {
+		t.Fatalf("TestLibraryAnyExtension: Browse returned err (%s)", err.Error())
+	}
+	if got, want := entryData(files), []string{"library:rasputin.mp3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TestLibraryAnyExtension: indexed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Gives the selected item if it's a timed link that's running, or nil.
+func (h *hub) activeLink() *PlaylistItem {
+	if sel := h.pl.Selected(); sel != nil && sel.IsTimedLink() && sel.State == ItemPlaying {
+		return sel
+	}
+	return nil
+}
+
+// Makes the selected timed link the active item.
+// Nothing's loaded for it, so whatever the downstream service had is ejected.
+func (h *hub) startLink() {
+	if h.downstreamState.State != baps3.StEjected {
+		h.cReqCh <- *baps3.NewMessage(baps3.RqEject)
+	}
+	h.setItemState(h.pl.Selected(), ItemPlaying)
+}
+
+// Counts down the active link, if any, ending it once its duration is up.
+// That advances the running order in the same way as a file ending, so long as auto-advance is on.
+func (h *hub) tickLink(now time.Time) {
+	link := h.activeLink()
+	if link == nil {
+		return
+	}
+	left := link.Started.Add(link.Duration()).Sub(now)
+	if left < 0 {
+		left = 0
+	}
+	h.broadcast(*baps3.NewMessage(RsLinkCountdown).AddArg(strconv.Itoa(h.pl.selection)).AddArg(link.Hash).AddArg(strconv.Itoa(int(left.Seconds()))))
+	if left == 0 {
+		h.handleRsEnd(*baps3.NewMessage(baps3.RsEnd))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestStartLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		state    baps3.State
+		wantSent []string
+	}{
+		{baps3.StEjected, nil},
+		{baps3.StStopped, []string{"eject"}},
+		{baps3.StPlaying, []string{"eject"}},
+	}
+	for caseno, c := range cases {
+		link := &PlaylistItem{Data: "Travel news", Hash: "aaa", Type: ItemLink, Meta: map[string]string{"duration": "60000000"}}
+		h, reqCh := newTestHub(t, dir, []*PlaylistItem{link}, 0)
+		h.downstreamState.State = c.state
+
+		h.startLink()
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestStartLink: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+		if h.activeLink() != link || link.Started.IsZero() {
+			t.Errorf("TestStartLink: case %d left link %v started at %v, want it active", caseno, link.State, link.Started)
+		}
+	}
+}
+
+func TestTickLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		state         ItemState
+		autoAdvance   bool
+		in            time.Duration
+		wantCountdown []string
+		wantState     ItemState
+		wantSel       int
+		wantSent      []string
+	}{
+		{ItemPlaying, true, 20 * time.Second, []string{"0", "aaa", "40"}, ItemPlaying, 0, nil},
+		// Test the link running out, which moves on like a file ending
+		{ItemPlaying, true, time.Minute, []string{"0", "aaa", "0"}, ItemPlayed, 1, []string{"load", "play"}},
+		{ItemPlaying, true, 90 * time.Second, []string{"0", "aaa", "0"}, ItemPlayed, 1, []string{"load", "play"}},
+		{ItemPlaying, false, time.Minute, []string{"0", "aaa", "0"}, ItemPlayed, 0, nil},
+		// Test a link that hasn't been started
+		{ItemQueued, true, time.Minute, nil, ItemQueued, 0, nil},
+	}
+	for caseno, c := range cases {
+		started := time.Unix(3600, 0)
+		link := &PlaylistItem{Data: "Travel news", Hash: "aaa", Type: ItemLink, Meta: map[string]string{"duration": "60000000"}, State: c.state, Started: started}
+		items := []*PlaylistItem{link, {Data: "library:rasputin.mp3", Hash: "bbb", Type: ItemFile}}
+		h, reqCh := newTestHub(t, dir, items, 0)
+		h.autoAdvance = c.autoAdvance
+		resCh := addTestClient(h)
+
+		h.tickLink(started.Add(c.in))
+		var countdown []string
+		for len(resCh) > 0 {
+			if res := <-resCh; res.Word() == RsLinkCountdown {
+				countdown = res.Args()
+			}
+		}
+		if !reflect.DeepEqual(countdown, c.wantCountdown) {
+			t.Errorf("TestTickLink: case %d counted down %v, want %v", caseno, countdown, c.wantCountdown)
+		}
+		if link.State != c.wantState {
+			t.Errorf("TestTickLink: case %d left link %v, want %v", caseno, link.State, c.wantState)
+		}
+		if h.pl.selection != c.wantSel {
+			t.Errorf("TestTickLink: case %d selected %d, want %d", caseno, h.pl.selection, c.wantSel)
+		}
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestTickLink: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+	}
+}
@@ -3,7 +3,12 @@ package main
 import (
 	"log"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	baps3 "github.com/UniversityRadioYork/baps3-go"
 )
@@ -23,17 +28,105 @@ type hub struct {
 	downstreamState baps3.ServiceState
 
 	autoAdvance bool
+	repeatMode  RepeatMode
+	stopMode    StopMode
 
-	// Playlist instance
-	pl *Playlist
+	// Hash of the item last stopped at its cue out, so it's only stopped once
+	cuedOut string
 
-	// For communication with the downstream service.
+	// All the playlists, the active one, and where they get saved (if anywhere)
+	pls    *PlaylistSet
+	pl     *Playlist
+	plPath string
+
+	// For communication with the downstream service, hearing of losing it, and waiting for its connectors to close.
 	cReqCh chan<- baps3.Message
 	cResCh <-chan baps3.Message
+	cErrCh <-chan error
+	connWG *sync.WaitGroup
 
 	// Where new requests from clients come through.
 	reqCh chan clientAndMessage
 
+	// Where the results of reading and checking file items' files come back.
+	fileCh chan fileResult
+	// The ffprobe used to read tags from files.
+	ffprobe string
+	// What file items must look like, and how often to check they still do.
+	validator       *fileValidator
+	recheckInterval time.Duration
+	// Files ffprobe couldn't read, by item hash, as they were when it tried.
+	// Rechecks leave those be until the file changes.
+	probeErrors map[string]fileStamp
+
+	// Index of the files in the media roots.
+	lib *library
+
+	// Log of everything played, if kept.
+	asRun *asRunLog
+
+	// Templates for recurring shows, if kept.
+	templates *templateStore
+
+	// Loudness analysis of file items, if on, the loudness gains are suggested for,
+	// and where measurements come back.
+	loudness       *loudnessAnalyser
+	loudnessTarget float64
+	loudCh         chan loudnessResult
+
+	// The next file item, being warmed up so it starts straight away, and how far that's got.
+	preloadHash  string
+	preloadState string
+	preloadCh    chan preloadResult
+
+	// How long nothing can be heard playing before falling back, what to fall back to,
+	// when something was last heard playing, and why automation has taken over, if it has.
+	silenceThreshold time.Duration
+	fallbackAddr     string
+	fallbackPlaylist string
+	lastPlaying      time.Time
+	alarm            string
+	// Whether nothing's meant to be playing, and whether the backup playd has yet to say what it can do.
+	held           bool
+	awaitingBackup bool
+
+	// Where clients reach this listd, and the primary (which may be this one).
+	advertise string
+	primary   string
+	// Standbys being streamed to, if this is, or could become, a primary, and where they connect to.
+	replicator    *replicator
+	replAdvertise string
+	// Which primary's reign it is. Each takeover starts a new term, so a primary that's been superseded can tell.
+	term int
+	// The primary followed while standing by, and watched for coming back once taken over from:
+	// where it streams from, how long it can go quiet, its updates, answers to send it, and how to stop following it.
+	// While standing by, also how far it had got with the selection.
+	standby         bool
+	primaryAddr     string
+	takeoverTimeout time.Duration
+	replCh          chan replicationUpdate
+	replyCh         chan replicationUpdate
+	followStop      chan struct{}
+	primaryPlaying  bool
+	primaryPosition time.Duration
+
+	// Projected timings last sent to clients, to the second, and what they were worked out from.
+	lastStarts map[string]int64
+	lastEnd    int64
+	lastBasis  timingBasis
+	lastOrigin time.Time
+	// Bumped on every change to the playlists, so timings know to be worked out again.
+	revision int
+
+	// When the playlist should end, if set, and how far off that it can be before clients are warned.
+	targetEnd      time.Time
+	driftThreshold time.Duration
+	lastDrift      int64
+	driftWarned    bool
+	// Whether to drop droppable items and add fillers (from the library directory fillerDir) to hit targetEnd.
+	autoFit   bool
+	fillerDir string
+
 	// Handlers for adding/removing connections.
 	addCh chan *Client
 	rmCh  chan *Client
@@ -73,23 +166,177 @@ func (h *hub) makeRsOhai() *baps3.Message {
 // Crafts the features message by adding listd's features to the downstream service's and removing
 // features listd intercepts.
 func (h *hub) makeRsFeatures() (msg *baps3.Message) {
-	features := h.downstreamState.Features
+	features := make(baps3.FeatureSet)
+	for ft := range h.downstreamState.Features {
+		features.AddFeature(ft)
+	}
 	features.DelFeature(baps3.FtFileLoad) // 'Mask' the features listd intercepts
 	features.AddFeature(baps3.FtPlaylist)
 	features.AddFeature(baps3.FtPlaylistTextItems)
+	features.AddFeature(FtPlaylistNotes)
+	features.AddFeature(FtPlaylistLinks)
+	features.AddFeature(FtPlaylistBreaks)
+	features.AddFeature(FtPlaylistURLs)
+	features.AddFeature(FtPlaylistTimedLinks)
+	features.AddFeature(FtNamedPlaylists)
 	features.AddFeature(baps3.FtPlaylistAutoAdvance)
-	msg = features.ToMessage()
+	features.AddFeature(FtPlaylistRepeat)
+	features.AddFeature(FtPlaylistStopAfter)
+	features.AddFeature(FtPlaylistMeta)
+	features.AddFeature(FtPlaylistFileErrors)
+	features.AddFeature(FtLibrary)
+	features.AddFeature(FtPlaylistItemStates)
+	features.AddFeature(FtPlaylistSchedule)
+	features.AddFeature(FtPlaylistTiming)
+	features.AddFeature(FtPlaylistEndTime)
+	features.AddFeature(FtPlaylistCues)
+	features.AddFeature(FtPlaylistLevels)
+	if h.asRun != nil {
+		features.AddFeature(FtAsRun)
+	}
+	if h.templates != nil {
+		features.AddFeature(FtTemplates)
+	}
+	if h.loudness != nil {
+		features.AddFeature(FtPlaylistLoudness)
+	}
+	features.AddFeature(FtPreload)
+	features.AddFeature(FtAlarm)
+	features.AddFeature(FtReplication)
+	msg = makeFeaturesMessage(features)
 	return
 }
 
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
 func (h *hub) makeRsAutoAdvance() (msg *baps3.Message) {
-	var autoadvancestate string
-	if h.autoAdvance {
-		autoadvancestate = "on"
-	} else {
-		autoadvancestate = "off"
+	return baps3.NewMessage(baps3.RsAutoAdvance).AddArg(onOff(h.autoAdvance))
+}
+
+func (h *hub) makeRsRepeat() *baps3.Message {
+	return baps3.NewMessage(RsRepeat).AddArg(h.repeatMode.String())
+}
+
+// Describes pl's current selection, which may be empty.
+func makeRsSelect(pl *Playlist) *baps3.Message {
+	if !pl.HasSelection() {
+		return baps3.NewMessage(baps3.RsSelect)
+	}
+	return baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(pl.selection)).AddArg(pl.items[pl.selection].Hash)
+}
+
+// Adds the arguments describing item to msg, as used by ITEM and ENQUEUE responses.
+func addItemArgs(msg *baps3.Message, i int, item *PlaylistItem) *baps3.Message {
+	return msg.AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(item.Type.String()).AddArg(item.Data)
+}
+
+func makeRsStopAfter(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsStopAfter).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(onOff(item.StopAfter))
+}
+
+func makeRsMeta(i int, item *PlaylistItem, key string) *baps3.Message {
+	return baps3.NewMessage(RsMeta).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(key).AddArg(item.Meta[key])
+}
+
+func makeRsFileError(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsFileError).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(item.FileError)
+}
+
+// Gives times as Unix seconds, or 0 for never.
+func unixStr(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func makeRsItemState(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsItemState).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(item.State.String()).AddArg(unixStr(item.Started)).AddArg(unixStr(item.Ended))
+}
+
+// Makes the responses giving item's stop-after marker, metadata, file problems and play state, if any.
+// These follow the ENQUEUE for item, or the whole run of ITEMs, so clients not knowing about them can ignore them.
+func makeItemDetailResponses(i int, item *PlaylistItem) (msgs []*baps3.Message) {
+	if item.StopAfter {
+		msgs = append(msgs, makeRsStopAfter(i, item))
+	}
+	for _, k := range item.MetaKeys() {
+		msgs = append(msgs, makeRsMeta(i, item, k))
+	}
+	if item.FileError != "" {
+		msgs = append(msgs, makeRsFileError(i, item))
+	}
+	if item.State != ItemQueued {
+		msgs = append(msgs, makeRsItemState(i, item))
+	}
+	if !item.StartAt.IsZero() {
+		msgs = append(msgs, makeRsSchedule(i, item))
+	}
+	if item.Droppable {
+		msgs = append(msgs, makeRsDroppable(i, item))
+	}
+	if item.Dropped {
+		msgs = append(msgs, makeRsDropped(i, item))
+	}
+	for _, name := range CueNames {
+		if *item.Cue(name) != 0 {
+			msgs = append(msgs, makeRsCue(i, item, name))
+		}
+	}
+	msgs = append(msgs, makeLevelResponses(i, item)...)
+	if item.Loudness != 0 {
+		msgs = append(msgs, makeRsLoudness(i, item))
+	}
+	return
+}
+
+// Moves item, if there is one, into state, telling clients if that changed anything.
+func (h *hub) setItemState(item *PlaylistItem, state ItemState) {
+	if item != nil && item.SetState(state, time.Now()) {
+		h.persist()
+		if name, i := h.pls.Locate(item); i >= 0 {
+			h.broadcast(*h.forPlaylist(name, makeRsItemState(i, item)))
+		}
+		if state == ItemPlayed || state == ItemSkipped {
+			h.recordAsRun(item)
+		}
+	}
+}
+
+// Logs item, which has just stopped being played, in the as-run log.
+// Must be called before the downstream state moves on to the next item.
+func (h *hub) recordAsRun(item *PlaylistItem) {
+	if h.asRun == nil || !item.IsFile() {
+		return
+	}
+	path, reason := h.validator.Resolve(item.Data)
+	if reason != "" {
+		path = item.Data // Best we can do
+	}
+	e := asRunEntry{
+		Start:   item.Started,
+		End:     item.Ended,
+		Played:  h.downstreamState.Time.Nanoseconds() / 1000,
+		Outcome: item.State.String(),
+		Data:    item.Data,
+		Path:    path,
+		Meta:    item.Meta,
+	}
+	if err := h.asRun.Record(e); err != nil {
+		log.Println("Error writing as-run log:", err.Error())
+	}
+}
+
+// Marks item as skipped if the selection has moved away from it part way through playing.
+func (h *hub) leaveItem(item *PlaylistItem) {
+	if item != nil && item.State == ItemPlaying && item != h.pl.Selected() {
+		h.setItemState(item, ItemSkipped)
 	}
-	return baps3.NewMessage(baps3.RsAutoAdvance).AddArg(autoadvancestate)
 }
 
 // Collates all the responses that comprise a dump response.
@@ -101,24 +348,63 @@ func (h *hub) makeDumpResponses() (msgs []*baps3.Message) {
 			strconv.FormatInt(h.downstreamState.Time.Nanoseconds()/1000, 10)))
 	}
 	msgs = append(msgs, h.makeRsAutoAdvance())
-	msgs = append(msgs, h.makeListResponses()...)
+	msgs = append(msgs, h.makeRsRepeat())
+	msgs = append(msgs, h.makeRsTargetEnd())
+	msgs = append(msgs, h.makeRsAutoFit())
+	msgs = append(msgs, h.makePlaylistsResponses()...)
+	msgs = append(msgs, h.makeListResponses(h.pl)...)
+	if h.preloadHash != "" {
+		msgs = append(msgs, h.makeRsPreload())
+	}
+	if h.alarm != "" {
+		msgs = append(msgs, h.makeRsAlarm())
+	}
+	msgs = append(msgs, h.makeRsPrimary())
 	return
 }
 
-// Collates all the responses that comprise a list reponse.
+// Collates all the responses that comprise a list reponse for pl.
 // Exists as this is used by the list response handler and makeDumpResponse.
-func (h *hub) makeListResponses() (msgs []*baps3.Message) {
-	msgs = append(msgs, baps3.NewMessage(baps3.RsCount).AddArg(strconv.Itoa(len(h.pl.items))))
-	for i, item := range h.pl.items {
-		typeStr := "file"
-		if !item.IsFile {
-			typeStr = "text"
-		}
-		msgs = append(msgs, baps3.NewMessage(baps3.RsItem).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(typeStr).AddArg(item.Data))
+// Only the active playlist is running, so only it has timings.
+func (h *hub) makeListResponses(pl *Playlist) (msgs []*baps3.Message) {
+	msgs = append(msgs, baps3.NewMessage(baps3.RsCount).AddArg(strconv.Itoa(len(pl.items))))
+	for i, item := range pl.items {
+		msgs = append(msgs, addItemArgs(baps3.NewMessage(baps3.RsItem), i, item))
+	}
+	// Details only once all COUNT's ITEMs are out, so as not to trip up clients counting them
+	for i, item := range pl.items {
+		msgs = append(msgs, makeItemDetailResponses(i, item)...)
+	}
+	if pl == h.pl {
+		msgs = append(msgs, h.makeTimingResponses()...)
 	}
 	return
 }
 
+// Saves the playlists, if somewhere to save them has been configured, and sends them to any standbys.
+func (h *hub) persist() {
+	h.revision++
+	h.replicate(true)
+	if h.plPath == "" {
+		return
+	}
+	if err := h.pls.Save(h.plPath, showEnd{h.targetEnd, h.autoFit}); err != nil {
+		log.Println("Error saving playlist:", err.Error())
+	}
+}
+
+// Records why the file of the item at i in pl can't be used ("" if it now can).
+// Returns the response telling clients about it, or nil if nothing changed.
+func (h *hub) setFileError(pl *Playlist, i int, reason string) *baps3.Message {
+	item := pl.items[i]
+	if item.FileError == reason {
+		return nil
+	}
+	item.FileError = reason
+	h.persist()
+	return makeRsFileError(i, item)
+}
+
 func sendInvalidCmd(c *Client, errRes baps3.Message, oldCmd baps3.Message) {
 	for _, w := range oldCmd.AsSlice() {
 		errRes.AddArg(w)
@@ -126,36 +412,77 @@ func sendInvalidCmd(c *Client, errRes baps3.Message, oldCmd baps3.Message) {
 	c.resCh <- errRes
 }
 
-func (h *hub) processReqDequeue(req baps3.Message) (resps []*baps3.Message) {
-	args := req.Args()
-	if len(args) != 2 {
-		return makeBadCommandMsgs()
+// Placeholder index in requests, meaning wherever the item with the given hash is now.
+// Saves clients racing each other to keep indices up to date.
+const anyIndex = "-"
+
+// Splits the arguments of a request addressing an item into its index and hash.
+// The index may be left out, which is the same as giving anyIndex.
+func splitItemArgs(args []string) (iStr string, hash string) {
+	if len(args) == 1 {
+		return anyIndex, args[0]
 	}
-	iStr, hash := args[0], args[1]
+	return args[0], args[1]
+}
 
+// Works out the index of an item in pl addressed in a request by iStr and hash,
+// looking the hash up if iStr is anyIndex.
+// Returns a response to send back instead if that can't be done.
+func resolveItemArgs(pl *Playlist, iStr string, hash string) (int, *baps3.Message) {
+	if iStr == anyIndex {
+		if i := pl.Find(hash); i >= 0 {
+			return i, nil
+		}
+		return 0, baps3.NewMessage(baps3.RsFail).AddArg("Hash not found")
+	}
 	i, err := strconv.Atoi(iStr)
 	if err != nil {
-		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad index"))
+		return 0, baps3.NewMessage(baps3.RsWhat).AddArg("Bad index")
+	}
+	return i, nil
+}
+
+func (h *hub) processReqDequeue(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 1 && len(args) != 2 {
+		return makeBadCommandMsgs()
 	}
+	iStr, hash := splitItemArgs(args)
 
-	oldSelection := h.pl.selection
-	rmIdx, rmHash, err := h.pl.Dequeue(i, hash)
+	var item *PlaylistItem
+	if j := pl.Find(hash); j >= 0 {
+		item = pl.items[j]
+	}
+	oldSelection := pl.selection
+	var rmIdx int
+	var err error
+	if iStr == anyIndex {
+		rmIdx, err = pl.DequeueHash(hash)
+	} else {
+		i, errResp := resolveItemArgs(pl, iStr, hash)
+		if errResp != nil {
+			return append(resps, errResp)
+		}
+		rmIdx, _, err = pl.Dequeue(i, hash)
+	}
 	if err != nil {
 		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
 	}
-	if oldSelection != h.pl.selection {
-		if !h.pl.HasSelection() {
-			resps = append(resps, baps3.NewMessage(baps3.RsSelect))
-		} else {
-			resps = append(resps, baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(h.pl.selection)).AddArg(h.pl.items[h.pl.selection].Hash))
-		}
+	if item.State == ItemPlaying && item.SetState(ItemSkipped, time.Now()) {
+		// Taken out part way through playing
+		resps = append(resps, makeRsItemState(rmIdx, item))
+		h.recordAsRun(item)
+	}
+	h.persist()
+	if oldSelection != pl.selection {
+		resps = append(resps, makeRsSelect(pl))
 	}
-	return append(resps, baps3.NewMessage(baps3.RsDequeue).AddArg(strconv.Itoa(rmIdx)).AddArg(rmHash))
+	return append(resps, baps3.NewMessage(baps3.RsDequeue).AddArg(strconv.Itoa(rmIdx)).AddArg(hash))
 }
 
-func (h *hub) processReqEnqueue(req baps3.Message) (resps []*baps3.Message) {
+func (h *hub) processReqEnqueue(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
 	args := req.Args()
-	if len(args) != 4 {
+	if len(args) < 4 {
 		return makeBadCommandMsgs()
 	}
 	iStr, hash, itemType, data := args[0], args[1], args[2], args[3]
@@ -165,20 +492,66 @@ func (h *hub) processReqEnqueue(req baps3.Message) (resps []*baps3.Message) {
 		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad index"))
 	}
 
-	if itemType != "file" && itemType != "text" {
-		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad item type"))
+	t, err := ParseItemType(itemType)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg(err.Error()))
+	}
+	if t == ItemFile {
+		if reason := h.validator.Validate(data); reason != "" {
+			return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("File "+reason))
+		}
+	}
+
+	item := &PlaylistItem{Data: data, Hash: hash, Type: t}
+	// Any further arguments are key=value metadata
+	for _, kv := range args[4:] {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad metadata"))
+		}
+		item.SetMeta(pair[0], pair[1])
+	}
+	if reason := checkItem(item); reason != "" {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg(reason))
 	}
 
-	oldSelection := h.pl.selection
-	item := &PlaylistItem{Data: data, Hash: hash, IsFile: itemType == "file"}
-	newIdx, err := h.pl.Enqueue(i, item)
+	oldSelection := pl.selection
+	newIdx, err := pl.Enqueue(i, item)
 	if err != nil {
 		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
 	}
-	if oldSelection != h.pl.selection {
-		resps = append(resps, baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(h.pl.selection)).AddArg(h.pl.items[h.pl.selection].Hash))
+	h.persist()
+	if item.IsFile() {
+		// Validated above, so this can't fail
+		path, _ := h.validator.Resolve(item.Data)
+		go readTags(h.ffprobe, item.Hash, item.Data, path, h.fileCh)
+		h.analyse(item.Hash, item.Data)
+	}
+	if oldSelection != pl.selection {
+		resps = append(resps, makeRsSelect(pl))
 	}
-	return append(resps, baps3.NewMessage(baps3.RsEnqueue).AddArg(strconv.Itoa(newIdx)).AddArg(item.Hash).AddArg(itemType).AddArg(item.Data))
+	resps = append(resps, addItemArgs(baps3.NewMessage(baps3.RsEnqueue), newIdx, item))
+	return append(resps, makeItemDetailResponses(newIdx, item)...)
+}
+
+// Checks the parts of a new item that depend on its type, other than a file item's file.
+// Returns why it's bad, or "" if it's fine.
+func checkItem(item *PlaylistItem) string {
+	switch item.Type {
+	case ItemLink:
+		// A link's target duration is optional, but it has to make sense
+		if d, ok := item.Meta["duration"]; ok {
+			if us, err := strconv.ParseInt(d, 10, 64); err != nil || us < 0 {
+				return "Bad duration"
+			}
+		}
+	case ItemURL:
+		u, err := url.Parse(item.Data)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "Bad URL"
+		}
+	}
+	return ""
 }
 
 func (h *hub) processReqSelect(req baps3.Message) (resps []*baps3.Message) {
@@ -186,36 +559,56 @@ func (h *hub) processReqSelect(req baps3.Message) (resps []*baps3.Message) {
 	if len(args) == 0 {
 		if h.pl.HasSelection() {
 			// Remove current selection
+			oldSelected := h.pl.Selected()
 			h.cReqCh <- *baps3.NewMessage(baps3.RqEject)
+			h.noteHeld()
 			h.pl.selection = -1
+			h.leaveItem(oldSelected)
 			resps = append(resps, baps3.NewMessage(baps3.RsSelect))
 		} else {
 			// TODO: Should we care about there not being an existing selection?
 			resps = append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No selection to remove"))
 		}
-	} else if len(args) == 2 {
-		iStr, hash := args[0], args[1]
+	} else if len(args) <= 2 {
+		iStr, hash := splitItemArgs(args)
 
-		i, err := strconv.Atoi(iStr)
-		if err != nil {
-			return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad index"))
+		// Don't let playd find out the hard way that the file's gone
+		if j := h.pl.Find(hash); j >= 0 && h.pl.items[j].IsFile() {
+			if reason := h.validator.Validate(h.pl.items[j].Data); reason != "" {
+				if msg := h.setFileError(h.pl, j, reason); msg != nil {
+					resps = append(resps, msg)
+				}
+				return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("File "+reason))
+			}
 		}
 
-		newIdx, newHash, err := h.pl.Select(i, hash)
+		oldSelected := h.pl.Selected()
+		var newIdx int
+		var err error
+		if iStr == anyIndex {
+			newIdx, err = h.pl.SelectHash(hash)
+		} else {
+			i, errResp := resolveItemArgs(h.pl, iStr, hash)
+			if errResp != nil {
+				return append(resps, errResp)
+			}
+			newIdx, _, err = h.pl.Select(i, hash)
+		}
 		if err != nil {
 			return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
 		}
+		h.leaveItem(oldSelected)
 
-		h.cReqCh <- *baps3.NewMessage(baps3.RqLoad).AddArg(h.pl.items[h.pl.selection].Data)
-		resps = append(resps, baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(newIdx)).AddArg(newHash))
+		h.loadSelected()
+		resps = append(resps, baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(newIdx)).AddArg(hash))
 	} else {
 		resps = makeBadCommandMsgs()
 	}
 	return
 }
 
-func (h *hub) processReqList(req baps3.Message) (resps []*baps3.Message) {
-	resps = h.makeListResponses()
+func (h *hub) processReqList(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	resps = h.makeListResponses(pl)
 	return
 }
 
@@ -243,34 +636,247 @@ func (h *hub) processReqAutoadvance(req baps3.Message) (msgs []*baps3.Message) {
 	return append(msgs, h.makeRsAutoAdvance())
 }
 
+func (h *hub) processReqRepeat(req baps3.Message) (msgs []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	modeStr, _ := req.Arg(0)
+	mode, err := ParseRepeatMode(modeStr)
+	if err != nil {
+		return append(msgs, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+	h.repeatMode = mode
+	return append(msgs, h.makeRsRepeat())
+}
+
+func (h *hub) processReqStopAfter(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 3 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, onoff := args[0], args[1], args[2]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+	if onoff != "on" && onoff != "off" {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+
+	curIdx, _, err := pl.SetStopAfter(i, hash, onoff == "on")
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, makeRsStopAfter(curIdx, pl.items[curIdx]))
+}
+
+func (h *hub) processReqSetMeta(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 4 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, key, value := args[0], args[1], args[2], args[3]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+
+	curIdx, curHash, err := pl.SetMeta(i, hash, key, value)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, baps3.NewMessage(RsMeta).AddArg(strconv.Itoa(curIdx)).AddArg(curHash).AddArg(key).AddArg(value))
+}
+
+// Adds the arguments describing a library file to msg, as used by RESULT responses.
+// These mirror the enqueue request, so a result can be enqueued as is.
+func addEntryArgs(msg *baps3.Message, e *libraryEntry) *baps3.Message {
+	return addMetaArgs(msg.AddArg("file").AddArg(e.Data), e.Meta)
+}
+
+// Adds meta to msg as key=value arguments, in the form the enqueue request takes.
+func addMetaArgs(msg *baps3.Message, meta map[string]string) *baps3.Message {
+	for _, k := range sortedKeys(meta) {
+		msg.AddArg(k + "=" + meta[k])
+	}
+	return msg
+}
+
+func (h *hub) processReqSearch(req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) == 0 {
+		return makeBadCommandMsgs()
+	}
+	if len(h.validator.roots) == 0 {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No media library"))
+	}
+
+	results := h.lib.Search(strings.Join(args, " "))
+	resps = append(resps, baps3.NewMessage(RsResults).AddArg(strconv.Itoa(len(results))))
+	for i, e := range results {
+		resps = append(resps, addEntryArgs(baps3.NewMessage(RsResult).AddArg(strconv.Itoa(i)), e))
+	}
+	return
+}
+
+func (h *hub) processReqBrowse(req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) > 1 {
+		return makeBadCommandMsgs()
+	}
+	if len(h.validator.roots) == 0 {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No media library"))
+	}
+	dir := ""
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	dirs, files, err := h.lib.Browse(dir)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	resps = append(resps, baps3.NewMessage(RsResults).AddArg(strconv.Itoa(len(dirs)+len(files))))
+	for i, d := range dirs {
+		resps = append(resps, baps3.NewMessage(RsResult).AddArg(strconv.Itoa(i)).AddArg("dir").AddArg(d))
+	}
+	for i, e := range files {
+		resps = append(resps, addEntryArgs(baps3.NewMessage(RsResult).AddArg(strconv.Itoa(len(dirs)+i)), e))
+	}
+	return
+}
+
+// Lists what was played on a given day (today if not given), oldest first.
+func (h *hub) processReqAsRun(req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) > 1 {
+		return makeBadCommandMsgs()
+	}
+	if h.asRun == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No as-run log"))
+	}
+	day := time.Now()
+	if len(args) == 1 {
+		var err error
+		if day, err = time.ParseInLocation(dateLayout, args[0], time.Local); err != nil {
+			return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad date"))
+		}
+	}
+
+	entries, err := h.asRun.Read(day)
+	if err != nil {
+		log.Println("Error reading as-run log:", err.Error())
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("Can't read as-run log"))
+	}
+	resps = append(resps, baps3.NewMessage(RsResults).AddArg(strconv.Itoa(len(entries))))
+	for i, e := range entries {
+		msg := baps3.NewMessage(RsAsRun).AddArg(strconv.Itoa(i)).AddArg(e.Outcome).AddArg(unixStr(e.Start)).AddArg(unixStr(e.End)).AddArg(strconv.FormatInt(e.Played, 10)).AddArg(e.Data)
+		resps = append(resps, addMetaArgs(msg, e.Meta))
+	}
+	return
+}
+
 var REQ_FUNC_MAP = map[baps3.MessageWord]func(*hub, baps3.Message) []*baps3.Message{
-	baps3.RqEnqueue:     (*hub).processReqEnqueue,
-	baps3.RqDequeue:     (*hub).processReqDequeue,
 	baps3.RqSelect:      (*hub).processReqSelect,
-	baps3.RqList:        (*hub).processReqList,
 	baps3.RqLoad:        (*hub).processReqLoadEject,
 	baps3.RqEject:       (*hub).processReqLoadEject,
 	baps3.RqDump:        (*hub).processReqDump,
 	baps3.RqAutoAdvance: (*hub).processReqAutoadvance,
+	RqRepeat:            (*hub).processReqRepeat,
+	RqSearch:            (*hub).processReqSearch,
+	RqBrowse:            (*hub).processReqBrowse,
+	RqAsRun:             (*hub).processReqAsRun,
+	RqEndTime:           (*hub).processReqEndTime,
+	RqAutoFit:           (*hub).processReqAutoFit,
+
+	RqPlaylists:        (*hub).processReqPlaylists,
+	RqCreatePlaylist:   (*hub).processReqCreatePlaylist,
+	RqDeletePlaylist:   (*hub).processReqDeletePlaylist,
+	RqRenamePlaylist:   (*hub).processReqRenamePlaylist,
+	RqCopyPlaylist:     (*hub).processReqCopyPlaylist,
+	RqActivatePlaylist: (*hub).processReqActivatePlaylist,
+
+	RqClearAlarm: (*hub).processReqClearAlarm,
+
+	RqTemplates:      (*hub).processReqTemplates,
+	RqSaveTemplate:   (*hub).processReqSaveTemplate,
+	RqDeleteTemplate: (*hub).processReqDeleteTemplate,
+	RqInstantiate:    (*hub).processReqInstantiate,
+}
+
+// Requests whose responses only go back to the client that asked, rather than to everyone.
+var REPLY_ONLY_REQS = map[baps3.MessageWord]bool{
+	RqSearch: true,
+	RqBrowse: true,
+	RqAsRun:  true,
+
+	RqTemplates: true,
+}
+
+// Handlers for requests that act on a playlist: the active one, or another given as a first argument of @name.
+var TARGETABLE_REQS = map[baps3.MessageWord]func(*hub, *Playlist, baps3.Message) []*baps3.Message{
+	baps3.RqEnqueue: (*hub).processReqEnqueue,
+	baps3.RqDequeue: (*hub).processReqDequeue,
+	baps3.RqList:    (*hub).processReqList,
+	RqStopAfter:     (*hub).processReqStopAfter,
+	RqSetMeta:       (*hub).processReqSetMeta,
+	RqSchedule:      (*hub).processReqSchedule,
+	RqDroppable:     (*hub).processReqDroppable,
+	RqCue:           (*hub).processReqCue,
+	RqGain:          (*hub).processReqGain,
+	RqFade:          (*hub).processReqFade,
+}
+
+// Requests a standby still answers, as they don't change anything.
+var STANDBY_REQS = map[baps3.MessageWord]bool{
+	baps3.RqList: true,
+	baps3.RqDump: true,
+	RqSearch:     true,
+	RqBrowse:     true,
+	RqAsRun:      true,
+	RqPlaylists:  true,
+	RqTemplates:  true,
 }
 
 // Handles a request from a client.
 // Falls through to the connector cReqCh if command is "not understood".
 func (h *hub) processRequest(c *Client, req baps3.Message) {
 	log.Println("New request:", req.String())
-	if reqFunc, ok := REQ_FUNC_MAP[req.Word()]; ok {
-		responses := reqFunc(h, req)
-		for _, resp := range responses {
-			// TODO: Add a "is fail word" func to baps3-go?
-			if resp.Word() == baps3.RsFail || resp.Word() == baps3.RsWhat {
-				// failures only go to sender
-				sendInvalidCmd(c, *resp, req)
-			} else {
-				h.broadcast(*resp)
-			}
+	if h.standby && !STANDBY_REQS[req.Word()] {
+		// Only the primary changes anything
+		sendInvalidCmd(c, *baps3.NewMessage(baps3.RsFail).AddArg("Standing by"), req)
+		return
+	}
+	var responses []*baps3.Message
+	if plFunc, ok := TARGETABLE_REQS[req.Word()]; ok {
+		if arg, _ := req.Arg(0); strings.HasPrefix(arg, "@") {
+			responses = h.processTargeted(plFunc, req)
+		} else {
+			responses = plFunc(h, h.pl, req)
 		}
+	} else if reqFunc, ok := REQ_FUNC_MAP[req.Word()]; ok {
+		responses = reqFunc(h, req)
 	} else {
+		if req.Word() == baps3.RqStop || req.Word() == baps3.RqEject {
+			h.noteHeld()
+		}
 		h.cReqCh <- req
+		return
+	}
+	for _, resp := range responses {
+		// TODO: Add a "is fail word" func to baps3-go?
+		if resp.Word() == baps3.RsFail || resp.Word() == baps3.RsWhat {
+			// failures only go to sender
+			sendInvalidCmd(c, *resp, req)
+		} else if REPLY_ONLY_REQS[req.Word()] {
+			c.resCh <- *resp
+		} else {
+			h.broadcast(*resp)
+		}
 	}
 }
 
@@ -279,9 +885,77 @@ func (h *hub) processRequest(c *Client, req baps3.Message) {
 //
 
 func (h *hub) handleRsEnd(res baps3.Message) {
-	if h.autoAdvance && h.pl.Advance() { // Selection changed
-		h.cReqCh <- *baps3.NewMessage(baps3.RqLoad).AddArg(h.pl.items[h.pl.selection].Data)
-		h.broadcast(*baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(h.pl.selection)))
+	if sel := h.pl.Selected(); sel != nil && sel.State == ItemPlaying {
+		h.setItemState(sel, ItemPlayed)
+	}
+	if h.fireSoftDue(time.Now()) { // Scheduled items take priority over the running order
+		return
+	}
+	if !h.autoAdvance {
+		return
+	}
+	if sel := h.pl.Selected(); sel != nil && sel.StopAfter {
+		// Halt here, optionally moving the selection on without loading it
+		h.noteHeld()
+		if h.stopMode == StopSelect && h.advance() {
+			h.broadcast(*makeRsSelect(h.pl))
+		}
+		return
+	}
+	if h.repeatMode == RepeatOne {
+		if h.pl.HasSelection() && h.loadSelected() { // Reload and play again, selection stays put
+			h.cReqCh <- *baps3.NewMessage(baps3.RqPlay)
+		}
+		return
+	}
+	if h.advance() { // Selection changed
+		if h.pl.HasSelection() && h.loadSelected() {
+			h.cReqCh <- *baps3.NewMessage(baps3.RqPlay)
+		}
+		h.broadcast(*makeRsSelect(h.pl))
+	}
+	if !h.pl.HasSelection() { // Ran out of running order
+		h.noteHeld()
+	}
+}
+
+// Asks the downstream service to load the selected item, expanding any media root reference in its data.
+// If the file can't be used, nothing is loaded, and the item is marked as such.
+// Timed links aren't loaded, but started in place.
+// Returns whether a file was loaded, so can be played.
+func (h *hub) loadSelected() bool {
+	if h.pl.Selected().IsTimedLink() {
+		h.startLink()
+		return false
+	}
+	path, reason := h.validator.Resolve(h.pl.Selected().Data)
+	if reason != "" {
+		log.Println("Not loading", h.pl.Selected().Data, ":", reason)
+		if msg := h.setFileError(h.pl, h.pl.selection, reason); msg != nil {
+			h.broadcast(*msg)
+		}
+		return false
+	}
+	h.cReqCh <- *baps3.NewMessage(baps3.RqLoad).AddArg(path)
+	h.seekToCueIn()
+	h.sendLevels()
+	return true
+}
+
+// Advances the playlist selection, wrapping round if the repeat mode says so.
+// Returns true if the selection changed.
+func (h *hub) advance() bool {
+	changed := h.pl.Advance()
+	if h.repeatMode == RepeatAll && !h.pl.HasSelection() { // Dropped off the bottom, wrap round
+		changed = h.pl.Rewind() || changed
+	}
+	return changed
+}
+
+// Picks up on the selected item starting to play, once the downstream state has been updated.
+func (h *hub) handleStateChange() {
+	if h.downstreamState.State == baps3.StPlaying {
+		h.setItemState(h.pl.Selected(), ItemPlaying)
 	}
 }
 
@@ -299,11 +973,71 @@ func (h *hub) processResponse(res baps3.Message) {
 		if err := h.downstreamState.Update(res); err != nil {
 			log.Fatal("Error updating state: " + err.Error())
 		}
+		if res.Word() == baps3.RsFeatures {
+			addLocalFeatures(h.downstreamState.Features, res)
+			if h.awaitingBackup {
+				h.playFallback()
+			}
+		}
+		h.notePlaying(time.Now())
+		switch res.Word() {
+		case baps3.RsState:
+			h.handleStateChange()
+		case baps3.RsTime:
+			h.handleTime()
+		}
 	default:
 		h.broadcast(res)
 	}
 }
 
+// Applies the tags read from, or problems found with, a file item's file, telling clients what changed.
+// Metadata already given by clients takes precedence over the file's own.
+func (h *hub) processFileResult(res fileResult) {
+	name, pl, i := h.findItem(res.hash, res.data)
+	if i < 0 {
+		delete(h.probeErrors, res.hash)
+		return // Item's gone, or been replaced, in the meantime
+	}
+	item := pl.items[i]
+
+	if res.recheck && res.fileError == "" && item.FileError != "" {
+		if stamp, ok := h.probeErrors[res.hash]; ok && stamp.same(res.stamp) {
+			return // Still the file ffprobe couldn't read
+		}
+		// See if ffprobe can read it now, rather than taking the recheck's word for it
+		path, _ := h.validator.Resolve(item.Data)
+		go readTags(h.ffprobe, item.Hash, item.Data, path, h.fileCh)
+		return
+	}
+	if !res.recheck {
+		if res.fileError == FileUnreadable {
+			h.probeErrors[res.hash] = res.stamp
+		} else {
+			delete(h.probeErrors, res.hash)
+		}
+	}
+
+	keys := make([]string, 0, len(res.meta))
+	for k := range res.meta {
+		if _, ok := item.Meta[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		item.SetMeta(k, res.meta[k])
+		h.broadcast(*h.forPlaylist(name, makeRsMeta(i, item, k)))
+	}
+
+	if len(keys) > 0 {
+		h.persist()
+	}
+	if msg := h.setFileError(pl, i, res.fileError); msg != nil {
+		h.broadcast(*h.forPlaylist(name, msg))
+	}
+}
+
 // Send a response message to all clients.
 func (h *hub) broadcast(res baps3.Message) {
 	for c, _ := range h.clients {
@@ -319,6 +1053,17 @@ func (h *hub) runListener(addr string, port string) {
 		return
 	}
 
+	h.analyseAll()
+	h.lastPlaying = time.Now() // Give playd a chance to get going
+
+	clock := time.NewTicker(time.Second)
+	var recheckCh <-chan time.Time
+	if h.recheckInterval > 0 {
+		recheckCh = time.NewTicker(h.recheckInterval).C
+	}
+	recheckDone := make(chan bool)
+	rechecking := false
+
 	// Get new connections
 	go func() {
 		for {
@@ -332,12 +1077,61 @@ func (h *hub) runListener(addr string, port string) {
 		}
 	}()
 
+	var superseded <-chan replicationUpdate
+	if h.replicator != nil {
+		superseded = h.replicator.Superseded
+	}
+
 	for {
 		select {
 		case msg := <-h.cResCh:
 			h.processResponse(msg)
+			h.updateTimings()
+			h.updatePreload()
+		case err := <-h.cErrCh:
+			h.lostDownstream(err)
+			h.updateTimings()
 		case data := <-h.reqCh:
 			h.processRequest(data.c, data.msg)
+			h.updateTimings()
+			h.updatePreload()
+		case res := <-h.fileCh:
+			h.processFileResult(res)
+			h.updateTimings()
+		case res := <-h.loudCh:
+			h.processLoudnessResult(res)
+		case res := <-h.preloadCh:
+			h.processPreloadResult(res)
+		case u, ok := <-h.replCh:
+			if !ok {
+				h.lostPrimary()
+			} else {
+				h.applyReplication(u)
+			}
+			h.updateTimings()
+		case u := <-superseded:
+			h.stepDown(u)
+			h.updateTimings()
+		case now := <-clock.C:
+			h.tick(now)
+			h.updateTimings()
+		case <-recheckCh:
+			if !rechecking { // Otherwise give a slow disk until next time
+				rechecking = true
+				var datas []map[string]string
+				for _, name := range h.pls.Names() {
+					datas = append(datas, h.pls.Get(name).FileData())
+				}
+				go func(datas []map[string]string) {
+					for _, d := range datas {
+						h.validator.Recheck(d, h.fileCh)
+					}
+					recheckDone <- true
+				}(datas)
+			}
+			h.analyseAll()
+		case <-recheckDone:
+			rechecking = false
 		case client := <-h.addCh:
 			h.clients[client] = true
 			client.resCh <- *h.makeRsOhai()
@@ -356,13 +1150,16 @@ func (h *hub) runListener(addr string, port string) {
 				close(c.resCh)
 				delete(h.clients, c)
 			}
+			close(h.cReqCh)
+			h.cReqCh = nil // Nothing more goes downstream
 			//			h.Quit <- true
 		}
 	}
 }
 
 // Sets up the connector channels for the hub object.
-func (h *hub) setConnector(cReqCh chan<- baps3.Message, cResCh <-chan baps3.Message) {
+func (h *hub) setConnector(cReqCh chan<- baps3.Message, cResCh <-chan baps3.Message, cErrCh <-chan error) {
 	h.cReqCh = cReqCh
 	h.cResCh = cResCh
+	h.cErrCh = cErrCh
 }
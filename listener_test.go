@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Makes a hub with items as its active playlist and sel selected, with auto-advance on.
+// File items' data should be under the media root "library", which is dir; their files are made there.
+// Requests to the downstream service are kept on the returned channel instead.
+func newTestHub(t *testing.T, dir string, items []*PlaylistItem, sel int) (*hub, <-chan baps3.Message) {
+	for _, item := range items {
+		if !item.IsFile() {
+			continue
+		}
+		p := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(item.Data, "library:")))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("ra ra"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := newFileValidator([]string{"library=" + dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqCh := make(chan baps3.Message, 16)
+	h := &hub{pls: InitPlaylistSet(), validator: v, autoAdvance: true, cReqCh: reqCh}
+	h.pl = makePlaylist(items, sel)
+	h.pls.playlists[DefaultPlaylistName] = h.pl
+	return h, reqCh
+}
+
+// Connects a client to h, which keeps what's broadcast to it on the returned channel.
+func addTestClient(h *hub) <-chan baps3.Message {
+	resCh := make(chan baps3.Message, 16)
+	if h.clients == nil {
+		h.clients = make(map[*Client]bool)
+	}
+	h.clients[&Client{resCh: resCh}] = true
+	return resCh
+}
+
+// Gives the words of the requests sent to the downstream service since last asked, in order.
+func sentWords(reqCh <-chan baps3.Message) (words []string) {
+	for {
+		select {
+		case req, ok := <-reqCh:
+			if !ok {
+				return // Closed, as when switching to a backup
+			}
+			words = append(words, wordString(req.Word()))
+		default:
+			return
+		}
+	}
+}
+
+func TestHandleRsEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		sel         int
+		autoAdvance bool
+		repeatMode  RepeatMode
+		wantSel     int
+		wantSent    []string
+		wantHeld    bool
+	}{
+		{0, true, RepeatNone, 1, []string{"load", "play"}, false},
+		// Test dropping off the bottom, and wrapping round
+		{1, true, RepeatNone, -1, nil, true},
+		{1, true, RepeatAll, 0, []string{"load", "play"}, false},
+		// Test repeating the one item
+		{0, true, RepeatOne, 0, []string{"load", "play"}, false},
+		{1, true, RepeatOne, 1, []string{"load", "play"}, false},
+		// Test auto-advance off, where the operator's in charge
+		{0, false, RepeatNone, 0, nil, false},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		}
+		items[c.sel].State = ItemPlaying
+		h, reqCh := newTestHub(t, dir, items, c.sel)
+		h.autoAdvance, h.repeatMode = c.autoAdvance, c.repeatMode
+
+		h.handleRsEnd(*baps3.NewMessage(baps3.RsEnd))
+		if items[c.sel].State != ItemPlayed {
+			t.Errorf("TestHandleRsEnd: case %d left ended item %v, want %v", caseno, items[c.sel].State, ItemPlayed)
+		}
+		if h.pl.selection != c.wantSel {
+			t.Errorf("TestHandleRsEnd: case %d selected %d, want %d", caseno, h.pl.selection, c.wantSel)
+		}
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestHandleRsEnd: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+		if h.held != c.wantHeld {
+			t.Errorf("TestHandleRsEnd: case %d left held %v, want %v", caseno, h.held, c.wantHeld)
+		}
+	}
+}
+
+func TestHandleRsEndStopAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		autoAdvance bool
+		stopMode    StopMode
+		wantSel     int
+		wantHeld    bool
+	}{
+		{true, StopHold, 0, true},
+		{true, StopSelect, 1, true},
+		// Test auto-advance off, which never advances anyway
+		{false, StopSelect, 0, false},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile, State: ItemPlaying, StopAfter: true},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		}
+		h, reqCh := newTestHub(t, dir, items, 0)
+		h.autoAdvance, h.stopMode = c.autoAdvance, c.stopMode
+
+		h.handleRsEnd(*baps3.NewMessage(baps3.RsEnd))
+		if h.pl.selection != c.wantSel {
+			t.Errorf("TestHandleRsEndStopAfter: case %d selected %d, want %d", caseno, h.pl.selection, c.wantSel)
+		}
+		if sent := sentWords(reqCh); sent != nil {
+			t.Errorf("TestHandleRsEndStopAfter: case %d sent %v, want nothing", caseno, sent)
+		}
+		if h.held != c.wantHeld {
+			t.Errorf("TestHandleRsEndStopAfter: case %d left held %v, want %v", caseno, h.held, c.wantHeld)
+		}
+	}
+}
+
+// Gives msg's word and arguments, for comparing.
+func msgStrings(msg *baps3.Message) []string {
+	if msg == nil {
+		return nil
+	}
+	return append([]string{wordString(msg.Word())}, msg.Args()...)
+}
+
+func TestSplitItemArgs(t *testing.T) {
+	cases := []struct {
+		args     []string
+		wantI    string
+		wantHash string
+	}{
+		{[]string{"1", "aaa"}, "1", "aaa"},
+		{[]string{anyIndex, "aaa"}, anyIndex, "aaa"},
+		// Test leaving the index out
+		{[]string{"aaa"}, anyIndex, "aaa"},
+	}
+	for _, c := range cases {
+		if iStr, hash := splitItemArgs(c.args); iStr != c.wantI || hash != c.wantHash {
+			t.Errorf("TestSplitItemArgs: splitItemArgs(%v) == %q, %q, want %q, %q", c.args, iStr, hash, c.wantI, c.wantHash)
+		}
+	}
+}
+
+func TestResolveItemArgs(t *testing.T) {
+	pl := makePlaylist([]*PlaylistItem{
+		{Data: "Travel news", Hash: "aaa", Type: ItemText},
+		{Data: "Weather", Hash: "bbb", Type: ItemText},
+	}, -1)
+
+	cases := []struct {
+		iStr     string
+		hash     string
+		wantI    int
+		wantResp []string
+	}{
+		{"1", "bbb", 1, nil},
+		{anyIndex, "bbb", 1, nil},
+		// Test an index that's out of date, which is left for the playlist to refuse
+		{"0", "bbb", 0, nil},
+		// Test a hash that isn't there, and an index that isn't one
+		{anyIndex, "zzz", 0, []string{"FAIL", "Hash not found"}},
+		{"one", "bbb", 0, []string{"WHAT", "Bad index"}},
+	}
+	for caseno, c := range cases {
+		i, resp := resolveItemArgs(pl, c.iStr, c.hash)
+		if i != c.wantI || !reflect.DeepEqual(msgStrings(resp), c.wantResp) {
+			t.Errorf("TestResolveItemArgs: case %d == %d, %v, want %d, %v", caseno, i, msgStrings(resp), c.wantI, c.wantResp)
+		}
+	}
+}
+
+func TestItemsByHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dequeue := func(h *hub, req baps3.Message) []*baps3.Message { return h.processReqDequeue(h.pl, req) }
+	sel := (*hub).processReqSelect
+	cases := []struct {
+		handler  func(*hub, baps3.Message) []*baps3.Message
+		args     []string
+		wantResp []string
+		wantLen  int
+		wantSel  int
+	}{
+		{dequeue, []string{"bbb"}, []string{"DEQUEUE", "1", "bbb"}, 2, -1},
+		{dequeue, []string{anyIndex, "ccc"}, []string{"DEQUEUE", "2", "ccc"}, 2, -1},
+		{sel, []string{"bbb"}, []string{"SELECT", "1", "bbb"}, 3, 1},
+		{sel, []string{anyIndex, "ccc"}, []string{"SELECT", "2", "ccc"}, 3, 2},
+		// Test a client that hasn't caught up with the list shifting down one
+		{dequeue, []string{"0", "bbb"}, []string{"FAIL", "Hash does not match"}, 3, -1},
+		{sel, []string{"0", "bbb"}, []string{"FAIL", "Hash does not match"}, 3, -1},
+		// Test hashes that aren't there
+		{dequeue, []string{"zzz"}, []string{"FAIL", "Hash not found"}, 3, -1},
+		{dequeue, []string{anyIndex, "zzz"}, []string{"FAIL", "Hash not found"}, 3, -1},
+		{sel, []string{"zzz"}, []string{"FAIL", "Hash not found"}, 3, -1},
+		{sel, []string{anyIndex, "zzz"}, []string{"FAIL", "Hash not found"}, 3, -1},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile},
+			{Data: "library:sunny.mp3", Hash: "ccc", Type: ItemFile},
+		}
+		h, _ := newTestHub(t, dir, items, -1)
+		req := baps3.NewMessage(baps3.BadWord)
+		for _, arg := range c.args {
+			req.AddArg(arg)
+		}
+
+		resps := c.handler(h, *req)
+		if got := msgStrings(resps[len(resps)-1]); !reflect.DeepEqual(got, c.wantResp) {
+			t.Errorf("TestItemsByHash: case %d responded %v, want %v", caseno, got, c.wantResp)
+		}
+		if n := len(h.pl.items); n != c.wantLen {
+			t.Errorf("TestItemsByHash: case %d left %d items, want %d", caseno, n, c.wantLen)
+		}
+		if h.pl.selection != c.wantSel {
+			t.Errorf("TestItemsByHash: case %d selected %d, want %d", caseno, h.pl.selection, c.wantSel)
+		}
+	}
+}
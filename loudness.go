@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// A measurement of the loudness of a file item's file.
+type loudnessResult struct {
+	hash     string
+	data     string
+	loudness float64 // EBU R128 integrated loudness, in LUFS
+	err      error
+}
+
+// A cached measurement, and the state of the file it was taken from.
+type loudnessEntry struct {
+	ModTime  time.Time
+	Size     int64
+	Loudness float64
+}
+
+// How many files can be waiting to be measured. Any more are measured once they're submitted again.
+const loudnessQueueLen = 1024
+
+// Measures the loudness of file items' files with ffmpeg, using a pool of workers.
+// Measurements are cached by path and modification time, so files are only measured again once they've changed,
+// and the cache is kept in a file, if given, so that holds across restarts too.
+type loudnessAnalyser struct {
+	ffmpeg    string
+	validator *fileValidator
+	cachePath string
+	jobs      chan loudnessResult
+
+	sync.Mutex
+	cache     map[string]loudnessEntry // Keyed by path
+	pending   map[string]bool          // Hashes of queued items, keyed by hash
+	measuring map[string]chan struct{} // Closed once the path's measurement is done, keyed by path
+}
+
+// Starts an analyser with the given number of workers, which send their measurements down resCh.
+// The cache is loaded from cachePath, unless it's empty.
+func newLoudnessAnalyser(ffmpeg string, validator *fileValidator, workers int, cachePath string, resCh chan<- loudnessResult) *loudnessAnalyser {
+	a := &loudnessAnalyser{
+		ffmpeg:    ffmpeg,
+		validator: validator,
+		cachePath: cachePath,
+		jobs:      make(chan loudnessResult, loudnessQueueLen),
+		cache:     make(map[string]loudnessEntry),
+		pending:   make(map[string]bool),
+		measuring: make(map[string]chan struct{}),
+	}
+	if cachePath != "" {
+		if err := a.load(); err != nil {
+			log.Println("Error loading loudness cache:", err.Error())
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go a.work(resCh)
+	}
+	return a
+}
+
+// Submit queues the file of the item with the given hash and data to be measured.
+// It doesn't wait for a worker to be free, and does nothing if the item's already queued.
+func (a *loudnessAnalyser) Submit(hash string, data string) {
+	a.Lock()
+	defer a.Unlock()
+	if a.pending[hash] {
+		return
+	}
+	select {
+	case a.jobs <- loudnessResult{hash: hash, data: data}:
+		a.pending[hash] = true
+	default:
+		log.Println("Loudness queue full, not measuring", data)
+	}
+}
+
+func (a *loudnessAnalyser) work(resCh chan<- loudnessResult) {
+	for job := range a.jobs {
+		a.Lock()
+		delete(a.pending, job.hash) // Changes from here on need measuring again
+		a.Unlock()
+		job.loudness, job.err = a.measure(job.data)
+		resCh <- job
+	}
+}
+
+// Gives the loudness of the file data refers to, from the cache if it hasn't changed since last time.
+// If another worker is already measuring the file, this waits for its measurement rather than running ffmpeg again.
+func (a *loudnessAnalyser) measure(data string) (float64, error) {
+	path, reason := a.validator.Resolve(data)
+	if reason != "" {
+		return 0, fmt.Errorf("File %s", reason)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	a.Lock()
+	for {
+		e, ok := a.cache[path]
+		if ok && e.ModTime.Equal(fi.ModTime()) && e.Size == fi.Size() {
+			a.Unlock()
+			return e.Loudness, nil
+		}
+		done, ok := a.measuring[path]
+		if !ok {
+			break
+		}
+		a.Unlock()
+		<-done
+		a.Lock()
+	}
+	done := make(chan struct{})
+	a.measuring[path] = done
+	a.Unlock()
+
+	loudness, err := measureLoudness(a.ffmpeg, path)
+
+	a.Lock()
+	defer a.Unlock()
+	delete(a.measuring, path)
+	close(done)
+	if err != nil {
+		return 0, err
+	}
+	a.cache[path] = loudnessEntry{ModTime: fi.ModTime(), Size: fi.Size(), Loudness: loudness}
+	if err := a.save(); err != nil {
+		log.Println("Error saving loudness cache:", err.Error())
+	}
+	return loudness, nil
+}
+
+// Reads the cache from cachePath. A missing file leaves it empty.
+func (a *loudnessAnalyser) load() error {
+	data, err := ioutil.ReadFile(a.cachePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &a.cache)
+}
+
+// Writes the cache to cachePath, if there is one. Must be called with the analyser locked.
+func (a *loudnessAnalyser) save() error {
+	if a.cachePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.cache, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(a.cachePath, data)
+}
+
+// Runs the file at path through ffmpeg's ebur128 filter, giving its integrated loudness.
+func measureLoudness(ffmpeg string, path string) (float64, error) {
+	out, err := exec.Command(ffmpeg, "-nostdin", "-hide_banner", "-nostats", "-i", path, "-filter_complex", "ebur128", "-f", "null", "-").CombinedOutput()
+	if err != nil {
+		return 0, err
+	}
+	return parseLoudness(out)
+}
+
+// Integrated loudness lines in ebur128's output. The last one is the summary for the whole file.
+var integratedRE = regexp.MustCompile(`\bI:\s+(-?[0-9.]+|-inf) LUFS`)
+
+// Picks the integrated loudness out of ffmpeg's ebur128 output.
+func parseLoudness(out []byte) (float64, error) {
+	matches := integratedRE.FindAllSubmatch(out, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("No loudness in ffmpeg output")
+	}
+	loudness, err := strconv.ParseFloat(string(matches[len(matches)-1][1]), 64)
+	if err != nil || math.IsInf(loudness, 0) {
+		return 0, fmt.Errorf("File is silent")
+	}
+	return loudness, nil
+}
+
+// Works out the gain, to a tenth of a dB, that brings something of the given loudness to the target.
+func suggestGain(loudness, target float64) float64 {
+	gain := math.Max(-MaxGain, math.Min(MaxGain, target-loudness))
+	return math.Floor(gain*10+0.5) / 10
+}
+
+func makeRsLoudness(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsLoudness).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(gainStr(item.Loudness)).AddArg(gainStr(item.SuggestedGain))
+}
+
+// Has the file of the item with the given hash and data measured, if loudness analysis is on.
+func (h *hub) analyse(hash string, data string) {
+	if h.loudness != nil {
+		h.loudness.Submit(hash, data)
+	}
+}
+
+// Has every file item in the active playlist measured, if loudness analysis is on.
+// Only files that have changed since they were last measured are actually analysed again.
+func (h *hub) analyseAll() {
+	for hash, data := range h.pl.FileData() {
+		h.analyse(hash, data)
+	}
+}
+
+// Stores a loudness measurement, and the gain it suggests, on its item.
+func (h *hub) processLoudnessResult(res loudnessResult) {
+	if res.err != nil {
+		log.Println("Error measuring loudness of", res.data, ":", res.err.Error())
+		return
+	}
+	name, pl, i := h.findItem(res.hash, res.data)
+	if i < 0 {
+		return // Item's gone, or been replaced, in the meantime
+	}
+	item := pl.items[i]
+	gain := suggestGain(res.loudness, h.loudnessTarget)
+	if item.Loudness == res.loudness && item.SuggestedGain == gain {
+		return
+	}
+	item.Loudness, item.SuggestedGain = res.loudness, gain
+	h.persist()
+	h.broadcast(*h.forPlaylist(name, makeRsLoudness(i, item)))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tail of what ffmpeg's ebur128 filter prints.
+const ebur128Output = `[Parsed_ebur128_0 @ 0x1] t: 2.99 TARGET:-23 LUFS    M: -19.1 S:-120.7     I: -19.1 LUFS       LRA:   0.0 LU
+[Parsed_ebur128_0 @ 0x1] Summary:
+
+  Integrated loudness:
+    I:         -18.7 LUFS
+    Threshold: -28.9 LUFS
+
+  Loudness range:
+    LRA:         2.1 LU
+`
+
+func TestParseLoudness(t *testing.T) {
+	if got, err := parseLoudness([]byte(ebur128Output)); err != nil || got != -18.7 {
+		t.Errorf("TestParseLoudness: == %v, %v, want -18.7", got, err)
+	}
+	if _, err := parseLoudness([]byte("    I:         -inf LUFS\n")); err == nil {
+		t.Errorf("TestParseLoudness: silent file returned nil when should be err")
+	}
+	if _, err := parseLoudness([]byte("rasputin.mp3: Invalid data found when processing input\n")); err == nil {
+		t.Errorf("TestParseLoudness: no summary returned nil when should be err")
+	}
+}
+
+func TestSuggestGain(t *testing.T) {
+	cases := []struct {
+		loudness float64
+		want     float64
+	}{
+		{-18.7, -4.3},
+		{-30.04, 7},
+		{-23, 0},
+		// Test clamping
+		{-120, MaxGain},
+	}
+	for _, c := range cases {
+		if got := suggestGain(c.loudness, -23); got != c.want {
+			t.Errorf("TestSuggestGain: suggestGain(%v, -23) == %v, want %v", c.loudness, got, c.want)
+		}
+	}
+}
+
+func TestLoudnessCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A stand-in for ffmpeg that notes each run
+	runs := filepath.Join(dir, "runs")
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\necho run >> " + runs + "\nsleep 0.2\necho '    I:         -18.7 LUFS'\n"
+	if err = ioutil.WriteFile(ffmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "rasputin.mp3")
+	if err = ioutil.WriteFile(file, []byte("ra ra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	validator, err := newFileValidator(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resCh := make(chan loudnessResult)
+	cache := filepath.Join(dir, "loudness.json")
+	a := newLoudnessAnalyser(ffmpeg, validator, 1, cache, resCh)
+	measure := func() {
+		a.Submit("aaa", file)
+		if res := <-resCh; res.err != nil || res.hash != "aaa" || res.loudness != -18.7 {
+			t.Errorf("TestLoudnessCache: result == %v, want -18.7 for aaa", res)
+		}
+	}
+	countRuns := func() int {
+		out, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(out), "run")
+	}
+
+	measure()
+	measure()
+	if n := countRuns(); n != 1 {
+		t.Errorf("TestLoudnessCache: ffmpeg ran %d times for unchanged file, want 1", n)
+	}
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	measure()
+	if n := countRuns(); n != 2 {
+		t.Errorf("TestLoudnessCache: ffmpeg ran %d times after file changed, want 2", n)
+	}
+
+	// Test a restart keeps the measurement
+	a = newLoudnessAnalyser(ffmpeg, validator, 1, cache, resCh)
+	measure()
+	if n := countRuns(); n != 2 {
+		t.Errorf("TestLoudnessCache: ffmpeg ran %d times after restart, want 2", n)
+	}
+
+	// Test items sharing a file only have it measured once, even by different workers
+	a = newLoudnessAnalyser(ffmpeg, validator, 2, "", resCh)
+	a.Submit("bbb", file)
+	a.Submit("ccc", file)
+	for i := 0; i < 2; i++ {
+		if res := <-resCh; res.err != nil || res.loudness != -18.7 {
+			t.Errorf("TestLoudnessCache: shared result == %v, want -18.7", res)
+		}
+	}
+	if n := countRuns(); n != 3 {
+		t.Errorf("TestLoudnessCache: ffmpeg ran %d times for a shared file, want 3", n)
+	}
+}
+
+func TestLoudnessPending(t *testing.T) {
+	validator, err := newFileValidator(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newLoudnessAnalyser("ffmpeg", validator, 0, "", make(chan loudnessResult))
+	a.Submit("aaa", "rasputin.mp3")
+	a.Submit("aaa", "rasputin.mp3")
+	a.Submit("bbb", "rasputin.mp3")
+	if n := len(a.jobs); n != 2 {
+		t.Errorf("TestLoudnessPending: %d jobs queued, want 2", n)
+	}
+}
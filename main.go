@@ -2,10 +2,13 @@ package main
 
 import (
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	baps3 "github.com/UniversityRadioYork/baps3-go"
 	"github.com/docopt/docopt-go"
@@ -17,7 +20,7 @@ func parseArgs() (args map[string]interface{}, err error) {
 	usage := `ury-listd-go.
 
 Usage:
-  ury-listd-go [-p <port>] [-a <address>] [-P <port>] [-A <address>]
+  ury-listd-go [options] [-r <dir>]...
   ury-listd-go -h
   ury-listd-go -v
 
@@ -26,6 +29,29 @@ Options:
   -a --addr=<address>           The host ury-listd-go listens on [default: 127.0.0.1].
   -P --playoutport=<port>       The playout system's listening port [default: 1350].
   -A --playoutaddr=<address>    The playout system's listening address [default: 127.0.0.1].
+  -s --stopmode=<mode>          What auto-advance does after a stop-after item, "hold" or "select" [default: hold].
+  -f --playlistfile=<file>      Where to save the playlists between runs (not saved if omitted).
+  --ffprobe=<path>              The ffprobe used to read tags from files [default: ffprobe].
+  -r --root=<dir>               A directory file items must be inside, given as [name=]dir; items can refer
+                                to files in it as name:path. May be repeated (any file if omitted).
+  -e --extensions=<exts>        Comma-separated extensions file items may have (any if omitted).
+  --recheck=<secs>              How often to re-check file items' files are still usable, 0 for never [default: 60].
+  --rescan=<secs>               How often to rescan the media roots for search and browse, 0 for only at startup [default: 300].
+  --asrundir=<dir>              Where to keep the daily as-run logs (not kept if omitted).
+  --drift=<secs>                How far the projected end can drift from the target end before warning [default: 30].
+  --fillers=<dir>               Library directory, as name:path, of fillers for auto-fit to use (none if omitted).
+  --templatedir=<dir>           Where to keep playlist templates (no templates if omitted).
+  --ffmpeg=<path>               The ffmpeg used to measure loudness [default: ffmpeg].
+  --loudnessworkers=<n>         How many files to measure the loudness of at once, 0 for no measuring [default: 2].
+  --loudnesscache=<file>        Where to keep loudness measurements between runs (not kept if omitted).
+  --loudnesstarget=<lufs>       The loudness suggested gains aim for [default: -23].
+  --silence=<secs>              How long nothing can play with auto-advance on before falling back, 0 for never [default: 0].
+  --fallbackaddr=<host:port>    A backup playout system to switch to on falling back (none if omitted).
+  --fallbackplaylist=<name>     The playlist to switch to on falling back (none if omitted).
+  --replicationport=<port>      The port to stream state to standby listds on (not streamed if omitted).
+  --primary=<host:port>         Stand by for the primary listd replicating on host:port, taking over if it goes.
+  --takeover=<secs>             How long the primary can go quiet before a standby takes over [default: 5].
+  --advertise=<host:port>       Where clients should connect to reach this listd (the listening host and port if omitted).
   -h --help                     Show this screen.
   -v --version                  Show version.`
 
@@ -39,15 +65,118 @@ func main() {
 		log.Fatal("Error parsing args: " + err.Error())
 	}
 
+	stopMode, err := ParseStopMode(args["--stopmode"].(string))
+	if err != nil {
+		log.Fatal("Error parsing args: " + err.Error())
+	}
+
+	pls := InitPlaylistSet()
+	var end showEnd
+	plPath, _ := args["--playlistfile"].(string)
+	if plPath != "" {
+		if pls, end, err = LoadPlaylistSet(plPath); err != nil {
+			log.Fatal("Error loading playlists: " + err.Error())
+		}
+	}
+	_, pl := pls.Active()
+
+	exts, _ := args["--extensions"].(string)
+	validator, err := newFileValidator(args["--root"].([]string), exts)
+	if err != nil {
+		log.Fatal("Error setting up media roots: " + err.Error())
+	}
+	if len(validator.roots) == 0 {
+		log.Println("No media roots, so clients can have playd open any file listd can read")
+	}
+	recheckSecs, err := strconv.Atoi(args["--recheck"].(string))
+	if err != nil || recheckSecs < 0 {
+		log.Fatal("Error parsing args: bad recheck interval")
+	}
+	rescanSecs, err := strconv.Atoi(args["--rescan"].(string))
+	if err != nil || rescanSecs < 0 {
+		log.Fatal("Error parsing args: bad rescan interval")
+	}
+	lib := newLibrary(args["--ffprobe"].(string), validator)
+	go lib.Run(time.Duration(rescanSecs) * time.Second)
+
+	driftSecs, err := strconv.Atoi(args["--drift"].(string))
+	if err != nil || driftSecs < 0 {
+		log.Fatal("Error parsing args: bad drift threshold")
+	}
+	fillerDir, _ := args["--fillers"].(string)
+
+	var asRun *asRunLog
+	if dir, _ := args["--asrundir"].(string); dir != "" {
+		asRun = &asRunLog{dir: dir}
+	}
+	loudnessWorkers, err := strconv.Atoi(args["--loudnessworkers"].(string))
+	if err != nil || loudnessWorkers < 0 {
+		log.Fatal("Error parsing args: bad number of loudness workers")
+	}
+	loudnessTarget, err := strconv.ParseFloat(args["--loudnesstarget"].(string), 64)
+	if err != nil {
+		log.Fatal("Error parsing args: bad loudness target")
+	}
+	loudCh := make(chan loudnessResult)
+	var loudness *loudnessAnalyser
+	if loudnessWorkers > 0 {
+		loudnessCache, _ := args["--loudnesscache"].(string)
+		loudness = newLoudnessAnalyser(args["--ffmpeg"].(string), validator, loudnessWorkers, loudnessCache, loudCh)
+	}
+
+	silenceSecs, err := strconv.Atoi(args["--silence"].(string))
+	if err != nil || silenceSecs < 0 {
+		log.Fatal("Error parsing args: bad silence threshold")
+	}
+	fallbackAddr, _ := args["--fallbackaddr"].(string)
+	fallbackPlaylist, _ := args["--fallbackplaylist"].(string)
+	if fallbackPlaylist != "" && pls.Get(fallbackPlaylist) == nil {
+		log.Fatal("Error parsing args: no such fallback playlist")
+	}
+
+	advertise, _ := args["--advertise"].(string)
+	if advertise == "" {
+		advertise = args["--addr"].(string) + ":" + args["--port"].(string)
+	}
+	var repl *replicator
+	var replAdvertise string
+	if port, _ := args["--replicationport"].(string); port != "" {
+		repl = newReplicator()
+		if _, err = repl.Listen(args["--addr"].(string) + ":" + port); err != nil {
+			log.Fatal("Error listening for standbys: " + err.Error())
+		}
+		host, _, err := net.SplitHostPort(advertise)
+		if err != nil {
+			log.Fatal("Error parsing args: bad advertised address")
+		}
+		replAdvertise = net.JoinHostPort(host, port)
+	}
+	takeoverSecs, err := strconv.Atoi(args["--takeover"].(string))
+	if err != nil || takeoverSecs <= 0 {
+		log.Fatal("Error parsing args: bad takeover time")
+	}
+	primary := advertise
+	primaryAddr, _ := args["--primary"].(string)
+	if primaryAddr != "" {
+		primary = "" // Not known until it says
+	}
+
+	var templates *templateStore
+	if dir, _ := args["--templatedir"].(string); dir != "" {
+		templates = &templateStore{dir: dir}
+	}
+
 	sigs := make(chan os.Signal)
 	signal.Notify(sigs, syscall.SIGINT)
 
 	responseCh := make(chan baps3.Message)
+	errorCh := make(chan error)
 	wg := new(sync.WaitGroup)
-	wg.Add(1)
 	connLog := log.New(os.Stderr, "playd:", 0)
-	connector := baps3.InitConnector("", responseCh, wg, connLog)
-	connector.Connect(args["--playoutaddr"].(string) + ":" + args["--playoutport"].(string))
+	connector := initConnector(responseCh, errorCh, wg, connLog)
+	if err := connector.Connect(args["--playoutaddr"].(string) + ":" + args["--playoutport"].(string)); err != nil {
+		log.Fatal("Error connecting to playd: " + err.Error())
+	}
 	go connector.Run()
 
 	var h = hub{
@@ -55,16 +184,60 @@ func main() {
 
 		downstreamState: *baps3.InitServiceState(),
 
-		pl: InitPlaylist(),
+		stopMode: stopMode,
+
+		pls:    pls,
+		pl:     pl,
+		plPath: plPath,
+
+		connWG: wg,
 
 		reqCh: make(chan clientAndMessage),
 
+		fileCh:          make(chan fileResult),
+		ffprobe:         args["--ffprobe"].(string),
+		validator:       validator,
+		recheckInterval: time.Duration(recheckSecs) * time.Second,
+		probeErrors:     make(map[string]fileStamp),
+
+		lib: lib,
+
+		asRun: asRun,
+
+		templates: templates,
+
+		loudness:       loudness,
+		loudnessTarget: loudnessTarget,
+		loudCh:         loudCh,
+
+		preloadCh: make(chan preloadResult),
+
+		silenceThreshold: time.Duration(silenceSecs) * time.Second,
+		fallbackAddr:     fallbackAddr,
+		fallbackPlaylist: fallbackPlaylist,
+
+		advertise:       advertise,
+		primary:         primary,
+		replicator:      repl,
+		replAdvertise:   replAdvertise,
+		term:            1,
+		standby:         primaryAddr != "",
+		takeoverTimeout: time.Duration(takeoverSecs) * time.Second,
+
+		targetEnd:      end.TargetEnd,
+		driftThreshold: time.Duration(driftSecs) * time.Second,
+		autoFit:        end.AutoFit,
+		fillerDir:      fillerDir,
+
 		addCh: make(chan *Client),
 		rmCh:  make(chan *Client),
 		Quit:  make(chan bool),
 	}
 
-	h.setConnector(connector.ReqCh, responseCh)
+	h.setConnector(connector.ReqCh, responseCh, errorCh)
+	if primaryAddr != "" {
+		h.followPrimary(primaryAddr)
+	}
 
 	go h.runListener(args["--addr"].(string), args["--port"].(string))
 
@@ -75,8 +248,7 @@ func main() {
 			log.Println("Exiting...")
 			h.Quit <- true
 			//<-h.Quit // Wait for quit to finish
-			close(connector.ReqCh)
-			wg.Wait()
+			wg.Wait() // The hub closes the connector as it quits
 			os.Exit(0)
 		}
 	}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The on-disk form of a playlist. The selection isn't kept, as it is meaningless
+// until the downstream service has loaded something.
+type savedPlaylist struct {
+	Items []*PlaylistItem
+}
+
+// The on-disk form of a playlist set, along with the show's end.
+type savedPlaylistSet struct {
+	Active    string
+	Playlists map[string]savedPlaylist
+	TargetEnd *time.Time `json:",omitempty"`
+	AutoFit   bool       `json:",omitempty"`
+}
+
+// When the show should end, and whether the playlist is fitted to that.
+// These are set on the hub, but saved with the playlists, as they're part of the show.
+type showEnd struct {
+	TargetEnd time.Time
+	AutoFit   bool
+}
+
+// Items are saved with their unset times left out, which omitempty can't do for a time.Time.
+func (item PlaylistItem) MarshalJSON() ([]byte, error) {
+	type plain PlaylistItem // Without this method, so marshalling it doesn't come back here
+	return json.Marshal(struct {
+		*plain
+		Started *time.Time `json:",omitempty"`
+		Ended   *time.Time `json:",omitempty"`
+		StartAt *time.Time `json:",omitempty"`
+	}{(*plain)(&item), optionalTime(item.Started), optionalTime(item.Ended), optionalTime(item.StartAt)})
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Save writes the playlist's items to path as JSON.
+func (pl *Playlist) Save(path string) error {
+	data, err := json.MarshalIndent(savedPlaylist{Items: pl.items}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// Save writes every playlist in the set, which is active, and the show's end, to path as JSON.
+func (s *PlaylistSet) Save(path string, end showEnd) error {
+	saved := s.saved()
+	saved.TargetEnd, saved.AutoFit = optionalTime(end.TargetEnd), end.AutoFit
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+func (s *PlaylistSet) saved() savedPlaylistSet {
+	saved := savedPlaylistSet{Active: s.active, Playlists: make(map[string]savedPlaylist, len(s.playlists))}
+	for name, pl := range s.playlists {
+		saved.Playlists[name] = savedPlaylist{Items: pl.items}
+	}
+	return saved
+}
+
+// Writes data to path.
+// The file is written alongside and renamed into place, so a crash mid-save leaves the old copy intact.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadPlaylist reads a playlist saved with Save from path.
+// A missing file gives an empty playlist, as nothing has been saved yet.
+func LoadPlaylist(path string) (*Playlist, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return InitPlaylist(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodePlaylist(data)
+}
+
+// LoadPlaylistSet reads a playlist set, and the show's end, saved with Save from path.
+// A lone playlist, as saved before there were sets, becomes the set's default playlist.
+// A missing file gives a set with just an empty default playlist.
+func LoadPlaylistSet(path string) (s *PlaylistSet, end showEnd, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return InitPlaylistSet(), end, nil
+	} else if err != nil {
+		return nil, end, err
+	}
+	if s, err = decodePlaylistSet(data); err != nil {
+		return nil, end, err
+	}
+	var saved struct {
+		TargetEnd *time.Time
+		AutoFit   bool
+	}
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, end, err
+	}
+	if saved.TargetEnd != nil {
+		end.TargetEnd = *saved.TargetEnd
+	}
+	end.AutoFit = saved.AutoFit
+	return s, end, nil
+}
+
+// Makes a playlist set out of its saved JSON form, or that of a lone playlist.
+func decodePlaylistSet(data []byte) (*PlaylistSet, error) {
+	var saved struct {
+		Active    string
+		Playlists map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	if saved.Playlists == nil {
+		pl, err := decodePlaylist(data)
+		if err != nil {
+			return nil, err
+		}
+		s := InitPlaylistSet()
+		s.playlists[DefaultPlaylistName] = pl
+		return s, nil
+	}
+
+	s := &PlaylistSet{playlists: make(map[string]*Playlist, len(saved.Playlists)), active: saved.Active}
+	for name, raw := range saved.Playlists {
+		var err error
+		if s.playlists[name], err = decodePlaylist(raw); err != nil {
+			return nil, fmt.Errorf("Playlist %q: %s", name, err.Error())
+		}
+	}
+	if s.playlists[s.active] == nil {
+		return nil, fmt.Errorf("Active playlist %q doesn't exist", s.active)
+	}
+	return s, nil
+}
+
+// Makes a playlist out of its saved JSON form.
+func decodePlaylist(data []byte) (*Playlist, error) {
+	var saved savedPlaylist
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	// Playlists saved before items had types only say whether each is a file
+	var legacy struct {
+		Items []struct{ IsFile *bool }
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	items := []*PlaylistItem{}
+	seen := make(map[string]bool)
+	for i, item := range saved.Items {
+		if isFile := legacy.Items[i].IsFile; isFile != nil && !*isFile {
+			item.Type = ItemText
+		}
+		if seen[item.Hash] {
+			return nil, fmt.Errorf("Hash %q appears more than once", item.Hash)
+		}
+		seen[item.Hash] = true
+		items = append(items, item)
+	}
+	return makePlaylist(items, -1), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "playlist.json")
+
+	// Nothing saved yet
+	got, err := LoadPlaylist(path)
+	if err != nil {
+		t.Fatalf("TestSaveLoad: loading missing file returned err (%s)", err.Error())
+	}
+	if !reflect.DeepEqual(got, InitPlaylist()) {
+		t.Errorf("TestSaveLoad: loading missing file gave %v, want empty playlist", got)
+	}
+
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: map[string]string{"artist": "Boney M."}},
+			&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText, StopAfter: true},
+		},
+		1,
+	)
+	if err = pl.Save(path); err != nil {
+		t.Fatalf("TestSaveLoad: save returned err (%s)", err.Error())
+	}
+	if got, err = LoadPlaylist(path); err != nil {
+		t.Fatalf("TestSaveLoad: load returned err (%s)", err.Error())
+	}
+	want := makePlaylist(pl.items, -1) // Selection isn't saved
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TestSaveLoad: loaded %v, want %v", got, want)
+	}
+
+	// Unset times are left out, and set ones kept
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); strings.Contains(s, "Started") || strings.Contains(s, "Ended") || strings.Contains(s, "StartAt") {
+		t.Errorf("TestSaveLoad: saved unset times in %s", s)
+	}
+	started := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	pl.items[0].SetState(ItemPlaying, started)
+	if err = pl.Save(path); err != nil {
+		t.Fatalf("TestSaveLoad: save returned err (%s)", err.Error())
+	}
+	if got, err = LoadPlaylist(path); err != nil {
+		t.Fatalf("TestSaveLoad: load returned err (%s)", err.Error())
+	}
+	if item := got.items[0]; !item.Started.Equal(started) || !item.Ended.IsZero() || item.State != ItemPlaying {
+		t.Errorf("TestSaveLoad: loaded state %v from %v to %v, want playing from %v", item.State, item.Started, item.Ended, started)
+	}
+
+	// Playlists from before item types
+	old := `{"Items": [{"Data": "rasputin.mp3", "Hash": "aaa", "IsFile": true}, {"Data": "Link: weather", "Hash": "link", "IsFile": false}]}`
+	if err = ioutil.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = LoadPlaylist(path); err != nil {
+		t.Fatalf("TestSaveLoad: loading old playlist returned err (%s)", err.Error())
+	}
+	if got.items[0].Type != ItemFile || got.items[1].Type != ItemText {
+		t.Errorf("TestSaveLoad: old playlist loaded types %v and %v, want file and text", got.items[0].Type, got.items[1].Type)
+	}
+}
+
+func TestSaveLoadSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "playlists.json")
+
+	// Nothing saved yet
+	got, gotEnd, err := LoadPlaylistSet(path)
+	if err != nil {
+		t.Fatalf("TestSaveLoadSet: loading missing file returned err (%s)", err.Error())
+	}
+	if !reflect.DeepEqual(got, InitPlaylistSet()) || gotEnd != (showEnd{}) {
+		t.Errorf("TestSaveLoadSet: loading missing file gave %v, %v, want default set and no end", got, gotEnd)
+	}
+
+	s := InitPlaylistSet()
+	s.Create("backup")
+	s.Get("backup").Enqueue(0, &PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile})
+	s.Activate("backup")
+	end := showEnd{TargetEnd: time.Unix(1420113600, 0), AutoFit: true}
+	if err = s.Save(path, end); err != nil {
+		t.Fatalf("TestSaveLoadSet: save returned err (%s)", err.Error())
+	}
+	if got, gotEnd, err = LoadPlaylistSet(path); err != nil {
+		t.Fatalf("TestSaveLoadSet: load returned err (%s)", err.Error())
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("TestSaveLoadSet: loaded %v, want %v", got, s)
+	}
+	if !gotEnd.TargetEnd.Equal(end.TargetEnd) || !gotEnd.AutoFit {
+		t.Errorf("TestSaveLoadSet: loaded end %v, want %v", gotEnd, end)
+	}
+
+	// A lone playlist becomes the default
+	pl := makePlaylist([]*PlaylistItem{&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile}}, -1)
+	if err = pl.Save(path); err != nil {
+		t.Fatalf("TestSaveLoadSet: save returned err (%s)", err.Error())
+	}
+	if got, gotEnd, err = LoadPlaylistSet(path); err != nil {
+		t.Fatalf("TestSaveLoadSet: loading lone playlist returned err (%s)", err.Error())
+	}
+	if name, active := got.Active(); name != DefaultPlaylistName || !reflect.DeepEqual(active, pl) {
+		t.Errorf("TestSaveLoadSet: lone playlist loaded as %q %v, want %q %v", name, active, DefaultPlaylistName, pl)
+	}
+}
@@ -1,40 +1,314 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"time"
 )
 
+// Enqueuing an item with this hash gets it a unique one generated for it.
+const PlaceholderHash = "*"
+
+// RepeatMode determines what auto-advance does when the selected item ends.
+type RepeatMode int
+
+const (
+	RepeatNone RepeatMode = iota // Advance, dropping off the bottom
+	RepeatAll                    // Advance, wrapping round to the first selectable item
+	RepeatOne                    // Reload the selected item
+)
+
+var repeatModeStrings = []string{"none", "all", "one"}
+
+func (m RepeatMode) String() string {
+	return repeatModeStrings[m]
+}
+
+// ParseRepeatMode converts a repeat mode name, as used in requests, to a RepeatMode.
+func ParseRepeatMode(s string) (RepeatMode, error) {
+	for i, str := range repeatModeStrings {
+		if str == s {
+			return RepeatMode(i), nil
+		}
+	}
+	return RepeatNone, fmt.Errorf("Bad repeat mode")
+}
+
+// StopMode determines what auto-advance does when an item marked stop-after ends.
+type StopMode int
+
+const (
+	StopHold   StopMode = iota // Don't advance at all
+	StopSelect                 // Advance the selection, but don't load it
+)
+
+var stopModeStrings = []string{"hold", "select"}
+
+func (m StopMode) String() string {
+	return stopModeStrings[m]
+}
+
+// ParseStopMode converts a stop mode name, as used in configuration, to a StopMode.
+func ParseStopMode(s string) (StopMode, error) {
+	for i, str := range stopModeStrings {
+		if str == s {
+			return StopMode(i), nil
+		}
+	}
+	return StopHold, fmt.Errorf("Bad stop mode")
+}
+
+// ItemState is how far an item has got through being played.
+type ItemState int
+
+const (
+	ItemQueued  ItemState = iota // Not played yet
+	ItemPlaying                  // Started playing, and still selected
+	ItemPlayed                   // Played to the end
+	ItemSkipped                  // Started playing, but deselected before the end
+)
+
+var itemStateStrings = []string{"queued", "playing", "played", "skipped"}
+
+func (s ItemState) String() string {
+	return itemStateStrings[s]
+}
+
+// ItemStates are saved by name, so saved playlists stay readable.
+func (s ItemState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ItemState) UnmarshalText(text []byte) error {
+	for i, str := range itemStateStrings {
+		if str == string(text) {
+			*s = ItemState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Bad item state %q", text)
+}
+
+// ItemType is what sort of thing an item is. Only file items are played by the downstream service.
+type ItemType int
+
+const (
+	ItemFile  ItemType = iota // An audio file
+	ItemText                  // Free text
+	ItemNote                  // Notes for the presenter
+	ItemLink                  // A presenter link, optionally with a target duration
+	ItemBreak                 // A marker for a break, such as the news or adverts
+	ItemURL                   // A web address, such as a page to read from
+)
+
+var itemTypeStrings = []string{"file", "text", "note", "link", "break", "url"}
+
+func (t ItemType) String() string {
+	return itemTypeStrings[t]
+}
+
+// ParseItemType converts an item type name, as used in requests, to an ItemType.
+func ParseItemType(s string) (ItemType, error) {
+	for i, str := range itemTypeStrings {
+		if str == s {
+			return ItemType(i), nil
+		}
+	}
+	return ItemText, fmt.Errorf("Bad item type")
+}
+
+// ItemTypes are saved by name, like ItemStates.
+func (t ItemType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *ItemType) UnmarshalText(text []byte) (err error) {
+	*t, err = ParseItemType(string(text))
+	return
+}
+
 type PlaylistItem struct {
-	Data   string
-	Hash   string
-	IsFile bool
+	Data      string
+	Hash      string
+	Type      ItemType
+	StopAfter bool              `json:",omitempty"` // Auto-advance halts once this item ends
+	Droppable bool              `json:",omitempty"` // Can be dropped to bring in an overrunning show
+	Meta      map[string]string `json:",omitempty"` // Free-form metadata, such as title and artist
+	FileError string            `json:",omitempty"` // Why a file item's file can't be used, if it can't
+
+	// Left out of the running order by auto-fit, to bring in an overrun. Worked out afresh each time, so not kept.
+	Dropped bool `json:"-"`
+
+	State   ItemState `json:",omitempty"`
+	Started time.Time // When the item last started playing
+	Ended   time.Time // When the item last finished or was skipped
+
+	// When the item should start playing by itself, if ever.
+	// A hard start interrupts whatever's playing; a soft one waits for it to finish.
+	StartAt   time.Time
+	HardStart bool `json:",omitempty"`
+
+	// Offsets into a file item's file, for talking over and segues. Zero means not set.
+	CueIn      time.Duration `json:",omitempty"` // Where playback starts
+	IntroEnd   time.Duration `json:",omitempty"` // Where vocals come in
+	OutroStart time.Duration `json:",omitempty"` // Where the outro begins
+	CueOut     time.Duration `json:",omitempty"` // Where playback stops
+
+	// Levels for a file item, applied by the downstream service.
+	Gain    float64       `json:",omitempty"` // In dB
+	FadeIn  time.Duration `json:",omitempty"`
+	FadeOut time.Duration `json:",omitempty"`
+
+	// A file item's measured loudness, in LUFS, and the gain, in dB, that would bring it to the target.
+	// Both are zero if the file hasn't been measured.
+	Loudness      float64 `json:",omitempty"`
+	SuggestedGain float64 `json:",omitempty"`
+}
+
+// The most gain, up or down, an item can have, in dB.
+const MaxGain = 60
+
+// Names of the fades, as used in requests.
+var FadeNames = []string{"in", "out"}
+
+// Fade gives a pointer to the fade with the given name, or nil if there isn't one.
+func (item *PlaylistItem) Fade(name string) *time.Duration {
+	switch name {
+	case "in":
+		return &item.FadeIn
+	case "out":
+		return &item.FadeOut
+	}
+	return nil
+}
+
+// IsFile says whether the item is an audio file, rather than something for the presenter.
+func (item *PlaylistItem) IsFile() bool {
+	return item.Type == ItemFile
+}
+
+// IsTimedLink says whether the item is a link with a target duration, which takes its turn in the running order.
+func (item *PlaylistItem) IsTimedLink() bool {
+	return item.Type == ItemLink && item.Duration() > 0
+}
+
+// Selectable says whether the item can be selected: files can, as can timed links.
+func (item *PlaylistItem) Selectable() bool {
+	return item.IsFile() || item.IsTimedLink()
+}
+
+// Names of the cue points, as used in requests.
+var CueNames = []string{"cuein", "intro", "outro", "cueout"}
+
+// Cue gives a pointer to the cue point with the given name, or nil if there isn't one.
+func (item *PlaylistItem) Cue(name string) *time.Duration {
+	switch name {
+	case "cuein":
+		return &item.CueIn
+	case "intro":
+		return &item.IntroEnd
+	case "outro":
+		return &item.OutroStart
+	case "cueout":
+		return &item.CueOut
+	}
+	return nil
+}
+
+// InRunningOrder says whether auto-advance gets to the item: it must be selectable, and not dropped.
+func (item *PlaylistItem) InRunningOrder() bool {
+	return item.Selectable() && !item.Dropped
+}
+
+// SetState moves the item into state at time t, returning false if it was already there.
+func (item *PlaylistItem) SetState(state ItemState, t time.Time) bool {
+	if item.State == state {
+		return false
+	}
+	item.State = state
+	switch state {
+	case ItemPlaying:
+		item.Started, item.Ended = t, time.Time{}
+	case ItemPlayed, ItemSkipped:
+		item.Ended = t
+	}
+	return true
+}
+
+// SetMeta sets the metadata key on item to value, removing it if value is empty.
+func (item *PlaylistItem) SetMeta(key string, value string) {
+	if value == "" {
+		delete(item.Meta, key)
+		if len(item.Meta) == 0 {
+			item.Meta = nil
+		}
+		return
+	}
+	if item.Meta == nil {
+		item.Meta = make(map[string]string)
+	}
+	item.Meta[key] = value
+}
+
+// MetaKeys returns the item's metadata keys in sorted order.
+func (item *PlaylistItem) MetaKeys() []string {
+	return sortedKeys(item.Meta)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 type Playlist struct {
 	items     []*PlaylistItem
 	selection int
+	// Position of each item in items, by hash. Kept up to date by insert and remove.
+	index map[string]int
 }
 
 func InitPlaylist() *Playlist {
 	pl := &Playlist{
 		selection: -1,
 		items:     []*PlaylistItem{},
+		index:     make(map[string]int),
 	}
 	return pl
 }
 
+// Makes a playlist out of items, which must have unique hashes, with the given selection.
+func makePlaylist(items []*PlaylistItem, selection int) *Playlist {
+	pl := &Playlist{
+		selection: selection,
+		items:     items,
+		index:     make(map[string]int, len(items)),
+	}
+	pl.reindex(0)
+	return pl
+}
+
+// Enqueue inserts item at idx, generating a hash for it if it has PlaceholderHash.
 func (pl *Playlist) Enqueue(idx int, item *PlaylistItem) (newIdx int, err error) {
-	for _, it := range pl.items {
-		if it.Hash == item.Hash {
-			err = fmt.Errorf("Hash already exists")
-			return
-		}
+	if item.Hash != PlaceholderHash && pl.Find(item.Hash) >= 0 {
+		err = fmt.Errorf("Hash already exists")
+		return
 	}
 
 	// appending on the end is necessary
 	if idx, err = pl.resolveIndex(idx, len(pl.items)+1); err != nil {
 		return
 	}
+	if item.Hash == PlaceholderHash {
+		if item.Hash, err = pl.newHash(); err != nil {
+			return
+		}
+	}
 	pl.insert(idx, item)
 	newIdx = idx
 	pl.changeSelection(true, newIdx)
@@ -43,14 +317,12 @@ func (pl *Playlist) Enqueue(idx int, item *PlaylistItem) (newIdx int, err error)
 }
 
 func (pl *Playlist) Dequeue(idx int, hash string) (oldIdx int, oldHash string, err error) {
-	if idx, err = pl.resolveIndex(idx, len(pl.items)); err != nil {
-		return
-	}
-	if pl.items[idx].Hash != hash {
-		err = fmt.Errorf("Hash does not match")
+	item, err := pl.item(idx, hash)
+	if err != nil {
 		return
 	}
-	oldIdx, oldHash = idx, pl.items[idx].Hash
+	idx = pl.Find(hash)
+	oldIdx, oldHash = idx, item.Hash
 	pl.remove(idx)
 	pl.changeSelection(false, oldIdx)
 	return
@@ -58,20 +330,261 @@ func (pl *Playlist) Dequeue(idx int, hash string) (oldIdx int, oldHash string, e
 
 // TODO: Way of deselecting current selection
 func (pl *Playlist) Select(idx int, hash string) (curIdx int, curHash string, err error) {
-	if idx, err = pl.resolveIndex(idx, len(pl.items)); err != nil {
+	item, err := pl.item(idx, hash)
+	if err != nil {
 		return
 	}
-	if pl.items[idx].Hash != hash {
-		err = fmt.Errorf("Hash does not match")
+	idx = pl.Find(hash)
+	if !item.Selectable() {
+		err = fmt.Errorf("Can only select a file or timed link")
 		return
 	}
-	if !pl.items[idx].IsFile {
-		err = fmt.Errorf("Can only select a file")
+
+	pl.selection = idx
+	curIdx, curHash = pl.selection, item.Hash
+	return
+}
+
+// SetStopAfter sets or clears the stop-after marker on the item at idx.
+func (pl *Playlist) SetStopAfter(idx int, hash string, stopAfter bool) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
 		return
 	}
+	idx = pl.Find(hash)
 
-	pl.selection = idx
-	curIdx, curHash = pl.selection, pl.items[idx].Hash
+	item.StopAfter = stopAfter
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// SetDroppable marks or unmarks the item at idx as droppable to bring in an overrun.
+func (pl *Playlist) SetDroppable(idx int, hash string, droppable bool) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
+		return
+	}
+	idx = pl.Find(hash)
+
+	item.Droppable = droppable
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// LastDroppable returns the index of the last droppable item after the selection and before before,
+// or -1 if there isn't one.
+func (pl *Playlist) LastDroppable(before int) int {
+	for i := before - 1; i > pl.selection; i-- {
+		if pl.items[i].Droppable {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetCue sets the named cue point of the file item at idx, clearing it if at is zero.
+func (pl *Playlist) SetCue(idx int, hash string, name string, at time.Duration) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
+		return
+	}
+	idx = pl.Find(hash)
+	if !item.IsFile() {
+		err = fmt.Errorf("Can only cue a file")
+		return
+	}
+	cue := item.Cue(name)
+	if cue == nil {
+		err = fmt.Errorf("Bad cue point")
+		return
+	}
+	if at < 0 {
+		err = fmt.Errorf("Cue point out of range")
+		return
+	}
+
+	old := *cue
+	*cue = at
+	if item.CueOut != 0 && item.CueOut <= item.CueIn {
+		*cue = old
+		err = fmt.Errorf("Cue out must be after cue in")
+		return
+	}
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// SetGain sets the gain, in dB, of the file item at idx.
+func (pl *Playlist) SetGain(idx int, hash string, gain float64) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
+		return
+	}
+	idx = pl.Find(hash)
+	if !item.IsFile() {
+		err = fmt.Errorf("Can only set the gain of a file")
+		return
+	}
+	if !(gain >= -MaxGain && gain <= MaxGain) { // Also catches NaN
+		err = fmt.Errorf("Gain out of range")
+		return
+	}
+
+	item.Gain = gain
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// SetFade sets the named fade of the file item at idx, clearing it if length is zero.
+func (pl *Playlist) SetFade(idx int, hash string, name string, length time.Duration) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
+		return
+	}
+	idx = pl.Find(hash)
+	if !item.IsFile() {
+		err = fmt.Errorf("Can only fade a file")
+		return
+	}
+	fade := item.Fade(name)
+	if fade == nil {
+		err = fmt.Errorf("Bad fade")
+		return
+	}
+	if length < 0 {
+		err = fmt.Errorf("Fade out of range")
+		return
+	}
+
+	*fade = length
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// SetMeta sets (or, if value is empty, removes) a metadata key on the item at idx.
+func (pl *Playlist) SetMeta(idx int, hash string, key string, value string) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
+		return
+	}
+	idx = pl.Find(hash)
+	if key == "" {
+		err = fmt.Errorf("Empty metadata key")
+		return
+	}
+
+	item.SetMeta(key, value)
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// Find returns the index of the item with the given hash, or -1 if there isn't one.
+func (pl *Playlist) Find(hash string) int {
+	if i, ok := pl.index[hash]; ok {
+		return i
+	}
+	return -1
+}
+
+// DequeueHash removes the item with the given hash, wherever it is.
+func (pl *Playlist) DequeueHash(hash string) (oldIdx int, err error) {
+	idx := pl.Find(hash)
+	if idx < 0 {
+		err = fmt.Errorf("Hash not found")
+		return
+	}
+	oldIdx, _, err = pl.Dequeue(idx, hash)
+	return
+}
+
+// SelectHash selects the item with the given hash, wherever it is.
+func (pl *Playlist) SelectHash(hash string) (curIdx int, err error) {
+	idx := pl.Find(hash)
+	if idx < 0 {
+		err = fmt.Errorf("Hash not found")
+		return
+	}
+	curIdx, _, err = pl.Select(idx, hash)
+	return
+}
+
+// FileData returns the data of all file items, keyed by hash.
+func (pl *Playlist) FileData() map[string]string {
+	datas := make(map[string]string)
+	for _, item := range pl.items {
+		if item.IsFile() {
+			datas[item.Hash] = item.Data
+		}
+	}
+	return datas
+}
+
+// SetSchedule sets when the file item at idx should start by itself, or clears it if at is zero.
+func (pl *Playlist) SetSchedule(idx int, hash string, at time.Time, hard bool) (curIdx int, curHash string, err error) {
+	item, err := pl.item(idx, hash)
+	if err != nil {
+		return
+	}
+	idx = pl.Find(hash)
+	if !item.IsFile() {
+		err = fmt.Errorf("Can only schedule a file")
+		return
+	}
+
+	item.StartAt, item.HardStart = at, hard && !at.IsZero()
+	curIdx, curHash = idx, item.Hash
+	return
+}
+
+// NextScheduled returns the index of the scheduled item due to start soonest, or -1 if none are scheduled.
+func (pl *Playlist) NextScheduled() int {
+	next := -1
+	for i, item := range pl.items {
+		if !item.StartAt.IsZero() && (next < 0 || item.StartAt.Before(pl.items[next].StartAt)) {
+			next = i
+		}
+	}
+	return next
+}
+
+// How late a scheduled item can still start, after which it has been missed.
+// Soft starts wait for whatever's playing to finish, so get longer.
+const (
+	HardStartGrace = time.Minute
+	SoftStartGrace = 15 * time.Minute
+)
+
+// Whether item was scheduled to start longer ago at now than its kind of start allows.
+func (item *PlaylistItem) missedStart(now time.Time) bool {
+	grace := SoftStartGrace
+	if item.HardStart {
+		grace = HardStartGrace
+	}
+	return !item.StartAt.IsZero() && now.Sub(item.StartAt) > grace
+}
+
+// Due returns the index of the item with the given kind of start that is due soonest at now,
+// or -1 if none are due. Missed starts aren't due.
+func (pl *Playlist) Due(now time.Time, hard bool) int {
+	due := -1
+	for i, item := range pl.items {
+		if item.StartAt.IsZero() || item.HardStart != hard || item.StartAt.After(now) || item.missedStart(now) {
+			continue
+		}
+		if due < 0 || item.StartAt.Before(pl.items[due].StartAt) {
+			due = i
+		}
+	}
+	return due
+}
+
+// Missed returns the indices of the items whose starts were missed at now, such as while listd wasn't running.
+func (pl *Playlist) Missed(now time.Time) (missed []int) {
+	for i, item := range pl.items {
+		if item.missedStart(now) {
+			missed = append(missed, i)
+		}
+	}
 	return
 }
 
@@ -83,31 +596,92 @@ func (pl *Playlist) HasSelection() bool {
 	return pl.selection >= 0
 }
 
-// Advance selects the next File item in the playlist, if it exists. Returns true if selection changed
+// Selected returns the currently selected item, or nil if there is no selection.
+func (pl *Playlist) Selected() *PlaylistItem {
+	if !pl.HasSelection() {
+		return nil
+	}
+	return pl.items[pl.selection]
+}
+
+// Advance selects the next item in the running order, if it exists. Returns true if selection changed
 func (pl *Playlist) Advance() bool {
 	if !pl.HasSelection() { // Don't advance if nothing selected
 		return false
 	}
 	for pl.selection++; pl.selection < len(pl.items); pl.selection++ {
-		if pl.items[pl.selection].IsFile {
+		if pl.items[pl.selection].InRunningOrder() {
 			return true
 		}
 	}
-	//Dropped off bottom, no more file items in playlist. Select none
+	//Dropped off bottom, no more selectable items in playlist. Select none
 	pl.selection = -1
 	return true
 }
 
+// Next gives the index of the item Advance would select, without selecting it, or -1 if there isn't one.
+func (pl *Playlist) Next() int {
+	if !pl.HasSelection() {
+		return -1
+	}
+	for i := pl.selection + 1; i < len(pl.items); i++ {
+		if pl.items[i].InRunningOrder() {
+			return i
+		}
+	}
+	return -1
+}
+
+// First gives the index of the item Rewind would select, without selecting it, or -1 if there isn't one.
+func (pl *Playlist) First() int {
+	for i, item := range pl.items {
+		if item.InRunningOrder() {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rewind selects the first item in the running order, if it exists. Returns true if selection changed
+func (pl *Playlist) Rewind() bool {
+	oldSelection := pl.selection
+	pl.selection = pl.First()
+	return pl.selection != oldSelection
+}
+
+// Makes a random hash not used by any item in the playlist.
+func (pl *Playlist) newHash() (string, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		if hash := hex.EncodeToString(b); pl.Find(hash) < 0 {
+			return hash, nil
+		}
+	}
+}
+
 func (pl *Playlist) insert(i int, item *PlaylistItem) {
 	// i must be valid index
 	pl.items = append(pl.items, nil)
 	copy(pl.items[i+1:], pl.items[i:])
 	pl.items[i] = item
+	pl.reindex(i)
 }
 
 func (pl *Playlist) remove(i int) {
 	// i must be valid index
+	delete(pl.index, pl.items[i].Hash)
 	pl.items[len(pl.items)-1], pl.items = nil, append(pl.items[:i], pl.items[i+1:]...)
+	pl.reindex(i)
+}
+
+// Updates the index for items from position i onwards, which have moved.
+func (pl *Playlist) reindex(i int) {
+	for ; i < len(pl.items); i++ {
+		pl.index[pl.items[i].Hash] = i
+	}
 }
 
 func (pl *Playlist) changeSelection(wasEnqueue bool, index int) {
@@ -129,6 +703,18 @@ func (pl *Playlist) changeSelection(wasEnqueue bool, index int) {
 	}
 }
 
+// Gets the item at idx, checking it's the one with the given hash.
+func (pl *Playlist) item(idx int, hash string) (*PlaylistItem, error) {
+	idx, err := pl.resolveIndex(idx, len(pl.items))
+	if err != nil {
+		return nil, err
+	}
+	if pl.items[idx].Hash != hash {
+		return nil, fmt.Errorf("Hash does not match")
+	}
+	return pl.items[idx], nil
+}
+
 func (pl *Playlist) resolveIndex(idx int, length int) (resolved int, err error) {
 	resolved = idx
 	if idx < 0 {
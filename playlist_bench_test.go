@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// A playlist the size of a long-running automation one.
+func makeBenchPlaylist(n int) *Playlist {
+	pl := InitPlaylist()
+	for i := 0; i < n; i++ {
+		pl.Enqueue(-1, &PlaylistItem{Data: "track" + strconv.Itoa(i) + ".mp3", Hash: strconv.Itoa(i), Type: ItemFile})
+	}
+	return pl
+}
+
+func BenchmarkEnqueue(b *testing.B) {
+	pl := makeBenchPlaylist(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pl.Enqueue(-1, &PlaylistItem{Data: "jingle.mp3", Hash: "new" + strconv.Itoa(i), Type: ItemFile})
+	}
+}
+
+func BenchmarkEnqueueDequeue(b *testing.B) {
+	pl := makeBenchPlaylist(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pl.Enqueue(2500, &PlaylistItem{Data: "jingle.mp3", Hash: "jingle", Type: ItemFile})
+		pl.DequeueHash("jingle")
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	pl := makeBenchPlaylist(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pl.Find(strconv.Itoa(i % 5000))
+	}
+}
+
+func BenchmarkSelectHash(b *testing.B) {
+	pl := makeBenchPlaylist(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pl.SelectHash(strconv.Itoa(i % 5000))
+	}
+}
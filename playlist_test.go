@@ -3,6 +3,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestInit(t *testing.T) {
@@ -12,10 +13,10 @@ func TestInit(t *testing.T) {
 	}{
 		{
 			InitPlaylist(),
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{},
 				-1,
-			},
+			),
 		},
 	}
 
@@ -36,62 +37,62 @@ func TestEnqueue(t *testing.T) {
 	}{
 		{
 			InitPlaylist(),
-			&PlaylistItem{"/Music/theballadofbilbobaggins.mp3", "aaa", true},
+			&PlaylistItem{Data: "/Music/theballadofbilbobaggins.mp3", Hash: "aaa", Type: ItemFile},
 			0,
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"/Music/theballadofbilbobaggins.mp3", "aaa", true},
+					&PlaylistItem{Data: "/Music/theballadofbilbobaggins.mp3", Hash: "aaa", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			false,
 		},
 		// Test invalid index
 		{
 			InitPlaylist(),
-			&PlaylistItem{"/Music/iamlordeyayaya.wav", "aaa", true},
+			&PlaylistItem{Data: "/Music/iamlordeyayaya.wav", Hash: "aaa", Type: ItemFile},
 			1,
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test hash collision
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"I am lorde ya ya ya", "aaa", true},
+					&PlaylistItem{Data: "I am lorde ya ya ya", Hash: "aaa", Type: ItemFile},
 				},
 				-1,
-			},
-			&PlaylistItem{"I too am lorde", "aaa", true},
+			),
+			&PlaylistItem{Data: "I too am lorde", Hash: "aaa", Type: ItemFile},
 			1,
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"I am lorde ya ya ya", "aaa", true},
+					&PlaylistItem{Data: "I am lorde ya ya ya", Hash: "aaa", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test selection adjustment
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"iamlorde.m4a", "ya", true},
+					&PlaylistItem{Data: "iamlorde.m4a", Hash: "ya", Type: ItemFile},
 				},
 				0,
-			},
-			&PlaylistItem{"iamsparticus.flac", "hurr", true},
+			),
+			&PlaylistItem{Data: "iamsparticus.flac", Hash: "hurr", Type: ItemFile},
 			0,
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"iamsparticus.flac", "hurr", true},
-					&PlaylistItem{"iamlorde.m4a", "ya", true},
+					&PlaylistItem{Data: "iamsparticus.flac", Hash: "hurr", Type: ItemFile},
+					&PlaylistItem{Data: "iamlorde.m4a", Hash: "ya", Type: ItemFile},
 				},
 				1, // Selection should have been adjusted, we enqueued before the selection
-			},
+			),
 			false,
 		},
 	}
@@ -121,18 +122,18 @@ func TestDequeue(t *testing.T) {
 	}{
 		// Test dequeue. NB, selection should reset to -1
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"darude - sandstorm.avi", "a1", true},
+					&PlaylistItem{Data: "darude - sandstorm.avi", Hash: "a1", Type: ItemFile},
 				},
 				0,
-			},
+			),
 			0,
 			"a1",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{},
 				-1,
-			},
+			),
 			false,
 		},
 		// Test dequeue empty
@@ -140,89 +141,89 @@ func TestDequeue(t *testing.T) {
 			InitPlaylist(),
 			0,
 			"yayaya",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test mismatching index and hash
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			0,
 			"b2",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test invalid index
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			1337,
 			"b2",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test invalid hash
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			0,
 			"c3",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test selection adjustment
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"a_walk_in_the_black_forest.ogg", "a1", true},
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "a_walk_in_the_black_forest.ogg", Hash: "a1", Type: ItemFile},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				1,
-			},
+			),
 			0,
 			"a1",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"cactus_in_my_yfronts.mid", "b2", true},
+					&PlaylistItem{Data: "cactus_in_my_yfronts.mid", Hash: "b2", Type: ItemFile},
 				},
 				0,
-			},
+			),
 			false,
 		},
 	}
@@ -252,92 +253,92 @@ func TestSelect(t *testing.T) {
 	}{
 		// Test select
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"airhorn.aac", "a1", true},
+					&PlaylistItem{Data: "airhorn.aac", Hash: "a1", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			0,
 			"a1",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"airhorn.aac", "a1", true},
+					&PlaylistItem{Data: "airhorn.aac", Hash: "a1", Type: ItemFile},
 				},
 				0,
-			},
+			),
 			false,
 		},
 		// Test invalid select
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"airhorn.aac", "a1", true},
+					&PlaylistItem{Data: "airhorn.aac", Hash: "a1", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			69,
 			"lol",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"airhorn.aac", "a1", true},
+					&PlaylistItem{Data: "airhorn.aac", Hash: "a1", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test invalid hash
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"illuminati.aiff", "hl3", true},
+					&PlaylistItem{Data: "illuminati.aiff", Hash: "hl3", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			0,
 			"notreally",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"illuminati.aiff", "hl3", true},
+					&PlaylistItem{Data: "illuminati.aiff", Hash: "hl3", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test invalid index
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"harderbetterfastergaben.opus", "pootis", true},
+					&PlaylistItem{Data: "harderbetterfastergaben.opus", Hash: "pootis", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			3,
 			"pootis",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"harderbetterfastergaben.opus", "pootis", true},
+					&PlaylistItem{Data: "harderbetterfastergaben.opus", Hash: "pootis", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 		// Test error on selecting text item
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"Half life 3", "hl3", false},
+					&PlaylistItem{Data: "Half life 3", Hash: "hl3", Type: ItemText},
 				},
 				-1,
-			},
+			),
 			0,
 			"hl3",
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"Half life 3", "hl3", false},
+					&PlaylistItem{Data: "Half life 3", Hash: "hl3", Type: ItemText},
 				},
 				-1,
-			},
+			),
 			true,
 		},
 	}
@@ -371,94 +372,115 @@ func TestAdvance(t *testing.T) {
 	}{
 		// Test advance on empty selection
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				-1,
-			},
-			&Playlist{
+			),
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 		},
 		// Test advance
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				0,
-			},
-			&Playlist{
+			),
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				1,
-			},
+			),
 		},
 		// Test advance on last item
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				1,
-			},
-			&Playlist{
+			),
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				-1,
-			},
+			),
 		},
 		// Test skipping of text items
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"Note to self: play more boney m.", "plzno", false},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				0,
-			},
-			&Playlist{
+			),
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"Note to self: play more boney m.", "plzno", false},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
 				},
 				2,
-			},
+			),
+		},
+		// Test stopping at timed links
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "Back-announce", Hash: "untimed", Type: ItemLink},
+					&PlaylistItem{Data: "Trail the quiz", Hash: "timed", Type: ItemLink, Meta: map[string]string{"duration": "30000000"}},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+				},
+				0,
+			),
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "Back-announce", Hash: "untimed", Type: ItemLink},
+					&PlaylistItem{Data: "Trail the quiz", Hash: "timed", Type: ItemLink, Meta: map[string]string{"duration": "30000000"}},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+				},
+				2,
+			),
 		},
 		// Test skipping of text items at end of playlist
 		{
-			&Playlist{
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
-					&PlaylistItem{"Note to self: play more boney m.", "plzno", false},
-					&PlaylistItem{"Thomas dolby 4 lyf", "science", false},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+					&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+					&PlaylistItem{Data: "Thomas dolby 4 lyf", Hash: "science", Type: ItemText},
 				},
 				1,
-			},
-			&Playlist{
+			),
+			makePlaylist(
 				[]*PlaylistItem{
-					&PlaylistItem{"rasputin.mp3", "aaa", true},
-					&PlaylistItem{"mabaker.mp3", "bbb", true},
-					&PlaylistItem{"Note to self: play more boney m.", "plzno", false},
-					&PlaylistItem{"Thomas dolby 4 lyf", "science", false},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+					&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+					&PlaylistItem{Data: "Thomas dolby 4 lyf", Hash: "science", Type: ItemText},
 				},
 				-1,
-			},
+			),
 		},
 	}
 
@@ -470,3 +492,644 @@ func TestAdvance(t *testing.T) {
 		}
 	}
 }
+
+func TestRewind(t *testing.T) {
+	cases := []struct {
+		before  *Playlist
+		want    *Playlist
+		changed bool
+	}{
+		// Test rewind on empty playlist
+		{
+			InitPlaylist(),
+			InitPlaylist(),
+			false,
+		},
+		// Test rewind from no selection
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+				},
+				-1,
+			),
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+				},
+				0,
+			),
+			true,
+		},
+		// Test rewind when first item already selected
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				0,
+			),
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				0,
+			),
+			false,
+		},
+		// Test skipping of text items at start of playlist
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+				},
+				2,
+			),
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+				},
+				1,
+			),
+			true,
+		},
+		// Test playlist with no file items
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "Thomas dolby 4 lyf", Hash: "science", Type: ItemText},
+				},
+				-1,
+			),
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "Thomas dolby 4 lyf", Hash: "science", Type: ItemText},
+				},
+				-1,
+			),
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		got := c.before
+		changed := got.Rewind()
+		if changed != c.changed {
+			t.Errorf("TestRewind: Rewind() returned %t, want %t", changed, c.changed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("TestRewind: %q.Rewind() == %q, want %q", c.before, got, c.want)
+		}
+	}
+}
+
+func TestSetStopAfter(t *testing.T) {
+	cases := []struct {
+		before      *Playlist
+		index       int
+		hash        string
+		stopAfter   bool
+		want        *Playlist
+		shoulderror bool
+	}{
+		// Test setting marker
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+					&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText},
+				},
+				-1,
+			),
+			0,
+			"aaa",
+			true,
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, StopAfter: true},
+					&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText},
+				},
+				-1,
+			),
+			false,
+		},
+		// Test clearing marker
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, StopAfter: true},
+				},
+				0,
+			),
+			-1,
+			"aaa",
+			false,
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				0,
+			),
+			false,
+		},
+		// Test mismatching index and hash
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			0,
+			"bbb",
+			true,
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			true,
+		},
+		// Test invalid index
+		{
+			InitPlaylist(),
+			0,
+			"aaa",
+			true,
+			InitPlaylist(),
+			true,
+		},
+	}
+
+	for caseno, c := range cases {
+		_, _, err := c.before.SetStopAfter(c.index, c.hash, c.stopAfter)
+		if c.shoulderror != (err != nil) {
+			if err != nil {
+				t.Errorf("TestSetStopAfter: case %d returned err when should be nil(%s)", caseno, err.Error())
+			} else {
+				t.Errorf("TestSetStopAfter: case %d returned nil when should be err", caseno)
+			}
+		}
+		if !reflect.DeepEqual(c.before, c.want) {
+			t.Errorf("TestSetStopAfter: %q != %q", c.before, c.want)
+		}
+	}
+}
+
+func TestSetMeta(t *testing.T) {
+	cases := []struct {
+		before      *Playlist
+		index       int
+		hash        string
+		key         string
+		value       string
+		want        *Playlist
+		shoulderror bool
+	}{
+		// Test adding a key
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			0,
+			"aaa",
+			"artist",
+			"Boney M.",
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: map[string]string{"artist": "Boney M."}},
+				},
+				-1,
+			),
+			false,
+		},
+		// Test removing the last key
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: map[string]string{"artist": "Boney M."}},
+				},
+				-1,
+			),
+			0,
+			"aaa",
+			"artist",
+			"",
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			false,
+		},
+		// Test empty key
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			0,
+			"aaa",
+			"",
+			"Boney M.",
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			true,
+		},
+		// Test mismatching index and hash
+		{
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			0,
+			"bbb",
+			"artist",
+			"Boney M.",
+			makePlaylist(
+				[]*PlaylistItem{
+					&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+				},
+				-1,
+			),
+			true,
+		},
+	}
+
+	for caseno, c := range cases {
+		_, _, err := c.before.SetMeta(c.index, c.hash, c.key, c.value)
+		if c.shoulderror != (err != nil) {
+			if err != nil {
+				t.Errorf("TestSetMeta: case %d returned err when should be nil(%s)", caseno, err.Error())
+			} else {
+				t.Errorf("TestSetMeta: case %d returned nil when should be err", caseno)
+			}
+		}
+		if !reflect.DeepEqual(c.before, c.want) {
+			t.Errorf("TestSetMeta: %v != %v", c.before, c.want)
+		}
+	}
+}
+
+func TestEnqueueGeneratesHash(t *testing.T) {
+	pl := InitPlaylist()
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		item := &PlaylistItem{Data: "rasputin.mp3", Hash: PlaceholderHash, Type: ItemFile}
+		if _, err := pl.Enqueue(-1, item); err != nil {
+			t.Fatalf("TestEnqueueGeneratesHash: enqueue %d returned err (%s)", i, err.Error())
+		}
+		if item.Hash == PlaceholderHash || item.Hash == "" {
+			t.Errorf("TestEnqueueGeneratesHash: enqueue %d left hash as %q", i, item.Hash)
+		}
+		if seen[item.Hash] {
+			t.Errorf("TestEnqueueGeneratesHash: enqueue %d reused hash %q", i, item.Hash)
+		}
+		seen[item.Hash] = true
+	}
+	if pl.Len() != 10 {
+		t.Errorf("TestEnqueueGeneratesHash: playlist has %d items, want 10", pl.Len())
+	}
+}
+
+func TestHashOperations(t *testing.T) {
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+			&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		},
+		-1,
+	)
+
+	if idx, err := pl.SelectHash("bbb"); err != nil || idx != 2 {
+		t.Errorf("TestHashOperations: SelectHash(bbb) == (%d, %v), want (2, nil)", idx, err)
+	}
+	if _, err := pl.SelectHash("plzno"); err == nil {
+		t.Errorf("TestHashOperations: SelectHash on text item returned nil when should be err")
+	}
+	if _, err := pl.SelectHash("ccc"); err == nil {
+		t.Errorf("TestHashOperations: SelectHash on missing hash returned nil when should be err")
+	}
+	if idx, err := pl.DequeueHash("aaa"); err != nil || idx != 0 {
+		t.Errorf("TestHashOperations: DequeueHash(aaa) == (%d, %v), want (0, nil)", idx, err)
+	}
+	if _, err := pl.DequeueHash("aaa"); err == nil {
+		t.Errorf("TestHashOperations: DequeueHash twice returned nil when should be err")
+	}
+
+	want := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+			&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		},
+		1,
+	)
+	if !reflect.DeepEqual(pl, want) {
+		t.Errorf("TestHashOperations: %v != %v", pl, want)
+	}
+}
+
+func TestSetState(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(1180, 0)
+	item := &PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile}
+
+	if item.SetState(ItemQueued, start) {
+		t.Errorf("TestSetState: SetState to current state returned true")
+	}
+	if !item.SetState(ItemPlaying, start) || item.State != ItemPlaying || item.Started != start {
+		t.Errorf("TestSetState: start playing gave %v", item)
+	}
+	if !item.SetState(ItemPlayed, end) || item.State != ItemPlayed || item.Started != start || item.Ended != end {
+		t.Errorf("TestSetState: finish playing gave %v", item)
+	}
+	// Playing again should forget the old end
+	if !item.SetState(ItemPlaying, end) || item.Started != end || !item.Ended.IsZero() {
+		t.Errorf("TestSetState: replaying gave %v", item)
+	}
+}
+
+func TestItemStateText(t *testing.T) {
+	for _, want := range []ItemState{ItemQueued, ItemPlaying, ItemPlayed, ItemSkipped} {
+		text, _ := want.MarshalText()
+		var got ItemState
+		if err := got.UnmarshalText(text); err != nil || got != want {
+			t.Errorf("TestItemStateText: %q gave (%v, %v), want %v", text, got, err, want)
+		}
+	}
+	var s ItemState
+	if err := s.UnmarshalText([]byte("paused")); err == nil {
+		t.Errorf("TestItemStateText: bad state returned nil when should be err")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	topOfHour := time.Unix(3600, 0)
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText},
+			&PlaylistItem{Data: "newsjingle.mp3", Hash: "news", Type: ItemFile},
+			&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+		},
+		0,
+	)
+
+	if idx := pl.NextScheduled(); idx != -1 {
+		t.Errorf("TestSchedule: NextScheduled with nothing scheduled == %d, want -1", idx)
+	}
+	if _, _, err := pl.SetSchedule(1, "link", topOfHour, true); err == nil {
+		t.Errorf("TestSchedule: scheduling text item returned nil when should be err")
+	}
+	if _, _, err := pl.SetSchedule(2, "news", topOfHour, true); err != nil {
+		t.Errorf("TestSchedule: scheduling returned err (%s)", err.Error())
+	}
+	if _, _, err := pl.SetSchedule(3, "bbb", topOfHour.Add(time.Minute), false); err != nil {
+		t.Errorf("TestSchedule: scheduling returned err (%s)", err.Error())
+	}
+
+	cases := []struct {
+		now      time.Time
+		wantHard int
+		wantSoft int
+	}{
+		{topOfHour.Add(-time.Second), -1, -1},
+		{topOfHour, 2, -1},
+		{topOfHour.Add(2 * time.Minute), -1, 3},
+		{topOfHour.Add(time.Hour), -1, -1},
+	}
+	for caseno, c := range cases {
+		if got := pl.Due(c.now, true); got != c.wantHard {
+			t.Errorf("TestSchedule: case %d hard Due == %d, want %d", caseno, got, c.wantHard)
+		}
+		if got := pl.Due(c.now, false); got != c.wantSoft {
+			t.Errorf("TestSchedule: case %d soft Due == %d, want %d", caseno, got, c.wantSoft)
+		}
+	}
+
+	missedCases := []struct {
+		now  time.Time
+		want []int
+	}{
+		{topOfHour.Add(HardStartGrace), nil},
+		{topOfHour.Add(2 * time.Minute), []int{2}},
+		{topOfHour.Add(time.Hour), []int{2, 3}},
+	}
+	for caseno, c := range missedCases {
+		if got := pl.Missed(c.now); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("TestSchedule: case %d Missed == %v, want %v", caseno, got, c.want)
+		}
+	}
+	if idx := pl.NextScheduled(); idx != 2 {
+		t.Errorf("TestSchedule: NextScheduled == %d, want 2", idx)
+	}
+
+	// Test clearing
+	if _, _, err := pl.SetSchedule(2, "news", time.Time{}, true); err != nil {
+		t.Errorf("TestSchedule: clearing returned err (%s)", err.Error())
+	}
+	if pl.items[2].HardStart {
+		t.Errorf("TestSchedule: clearing left hard start set")
+	}
+	if idx := pl.NextScheduled(); idx != 3 {
+		t.Errorf("TestSchedule: NextScheduled after clearing == %d, want 3", idx)
+	}
+}
+
+func TestLastDroppable(t *testing.T) {
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+			&PlaylistItem{Data: "science.mp3", Hash: "ccc", Type: ItemFile},
+		},
+		1,
+	)
+
+	if idx := pl.LastDroppable(pl.Len()); idx != -1 {
+		t.Errorf("TestLastDroppable: with nothing droppable == %d, want -1", idx)
+	}
+	if _, _, err := pl.SetDroppable(0, "aaa", true); err != nil {
+		t.Errorf("TestLastDroppable: SetDroppable returned err (%s)", err.Error())
+	}
+	if idx := pl.LastDroppable(pl.Len()); idx != -1 {
+		t.Errorf("TestLastDroppable: with only item before selection droppable == %d, want -1", idx)
+	}
+	if _, _, err := pl.SetDroppable(2, "ccc", true); err != nil {
+		t.Errorf("TestLastDroppable: SetDroppable returned err (%s)", err.Error())
+	}
+	if idx := pl.LastDroppable(pl.Len()); idx != 2 {
+		t.Errorf("TestLastDroppable: == %d, want 2", idx)
+	}
+	if idx := pl.LastDroppable(2); idx != -1 {
+		t.Errorf("TestLastDroppable: before 2 == %d, want -1", idx)
+	}
+	if _, _, err := pl.SetDroppable(2, "bbb", true); err == nil {
+		t.Errorf("TestLastDroppable: SetDroppable with mismatching hash returned nil when should be err")
+	}
+}
+
+func TestSetCue(t *testing.T) {
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText},
+		},
+		-1,
+	)
+
+	cases := []struct {
+		idx     int
+		hash    string
+		name    string
+		at      time.Duration
+		wantErr bool
+	}{
+		{0, "aaa", "cuein", 2 * time.Second, false},
+		{0, "aaa", "intro", 15 * time.Second, false},
+		{0, "aaa", "cueout", 180 * time.Second, false},
+		// Test cue out before cue in
+		{0, "aaa", "cueout", time.Second, true},
+		// Test cue in after cue out
+		{0, "aaa", "cuein", 200 * time.Second, true},
+		// Test unknown cue point
+		{0, "aaa", "middle", time.Second, true},
+		// Test negative offset
+		{0, "aaa", "outro", -time.Second, true},
+		// Test mismatching hash
+		{0, "link", "cuein", time.Second, true},
+		// Test cueing a text item
+		{1, "link", "cuein", time.Second, true},
+	}
+
+	for caseno, c := range cases {
+		_, _, err := pl.SetCue(c.idx, c.hash, c.name, c.at)
+		if (err != nil) != c.wantErr {
+			t.Errorf("TestSetCue: case %d returned err %v, want err %v", caseno, err, c.wantErr)
+		}
+	}
+
+	item := pl.items[0]
+	if item.CueIn != 2*time.Second || item.IntroEnd != 15*time.Second || item.OutroStart != 0 || item.CueOut != 180*time.Second {
+		t.Errorf("TestSetCue: cues == %v %v %v %v, want 2s 15s 0s 3m0s", item.CueIn, item.IntroEnd, item.OutroStart, item.CueOut)
+	}
+}
+
+func TestParseItemType(t *testing.T) {
+	for i, str := range []string{"file", "text", "note", "link", "break", "url"} {
+		got, err := ParseItemType(str)
+		if err != nil || got != ItemType(i) || got.String() != str {
+			t.Errorf("TestParseItemType: ParseItemType(%q) == %v, %v", str, got, err)
+		}
+	}
+	if _, err := ParseItemType("video"); err == nil {
+		t.Errorf("TestParseItemType: ParseItemType(\"video\") returned nil when should be err")
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+			&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText},
+		},
+		-1,
+	)
+
+	gainCases := []struct {
+		idx     int
+		hash    string
+		gain    float64
+		wantErr bool
+	}{
+		{0, "aaa", -3.5, false},
+		// Test out of range gain
+		{0, "aaa", 61, true},
+		// Test mismatching hash
+		{0, "link", 1, true},
+		// Test gain on a text item
+		{1, "link", 1, true},
+	}
+	for caseno, c := range gainCases {
+		if _, _, err := pl.SetGain(c.idx, c.hash, c.gain); (err != nil) != c.wantErr {
+			t.Errorf("TestSetLevels: gain case %d returned err %v, want err %v", caseno, err, c.wantErr)
+		}
+	}
+
+	fadeCases := []struct {
+		idx     int
+		hash    string
+		name    string
+		length  time.Duration
+		wantErr bool
+	}{
+		{0, "aaa", "in", 2 * time.Second, false},
+		{0, "aaa", "out", 5 * time.Second, false},
+		// Test unknown fade
+		{0, "aaa", "across", time.Second, true},
+		// Test negative length
+		{0, "aaa", "in", -time.Second, true},
+		// Test fade on a text item
+		{1, "link", "in", time.Second, true},
+	}
+	for caseno, c := range fadeCases {
+		if _, _, err := pl.SetFade(c.idx, c.hash, c.name, c.length); (err != nil) != c.wantErr {
+			t.Errorf("TestSetLevels: fade case %d returned err %v, want err %v", caseno, err, c.wantErr)
+		}
+	}
+
+	item := pl.items[0]
+	if item.Gain != -3.5 || item.FadeIn != 2*time.Second || item.FadeOut != 5*time.Second {
+		t.Errorf("TestSetLevels: levels == %v %v %v, want -3.5 2s 5s", item.Gain, item.FadeIn, item.FadeOut)
+	}
+}
+
+func TestNext(t *testing.T) {
+	items := []*PlaylistItem{
+		&PlaylistItem{Data: "Note to self: play more boney m.", Hash: "plzno", Type: ItemText},
+		&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile},
+		&PlaylistItem{Data: "Back-announce", Hash: "untimed", Type: ItemLink},
+		&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile},
+	}
+	cases := []struct {
+		selection int
+		next      int
+	}{
+		{-1, -1},
+		{1, 3},
+		// Test nothing after the selection
+		{3, -1},
+	}
+	for _, c := range cases {
+		pl := makePlaylist(items, c.selection)
+		if got := pl.Next(); got != c.next {
+			t.Errorf("TestNext: with selection %d, Next() == %d, want %d", c.selection, got, c.next)
+		}
+		if got := pl.First(); got != 1 {
+			t.Errorf("TestNext: with selection %d, First() == %d, want 1", c.selection, got)
+		}
+		if !reflect.DeepEqual(pl, makePlaylist(items, c.selection)) {
+			t.Errorf("TestNext: with selection %d, playlist changed", c.selection)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// The playlist there is before any others have been made.
+const DefaultPlaylistName = "main"
+
+// PlaylistSet holds a show's alternate running orders by name.
+// Only the active one drives the downstream service; the rest have nothing selected.
+type PlaylistSet struct {
+	playlists map[string]*Playlist
+	active    string
+}
+
+// InitPlaylistSet makes a set holding just an empty, active default playlist.
+func InitPlaylistSet() *PlaylistSet {
+	return &PlaylistSet{
+		playlists: map[string]*Playlist{DefaultPlaylistName: InitPlaylist()},
+		active:    DefaultPlaylistName,
+	}
+}
+
+// Active gives the active playlist and its name.
+func (s *PlaylistSet) Active() (name string, pl *Playlist) {
+	return s.active, s.playlists[s.active]
+}
+
+// Get gives the playlist called name, or nil if there isn't one.
+func (s *PlaylistSet) Get(name string) *Playlist {
+	return s.playlists[name]
+}
+
+// Names gives the names of all the playlists, in order.
+func (s *PlaylistSet) Names() []string {
+	names := make([]string, 0, len(s.playlists))
+	for name := range s.playlists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create adds a new, empty playlist called name.
+func (s *PlaylistSet) Create(name string) error {
+	if err := s.checkNew(name); err != nil {
+		return err
+	}
+	s.playlists[name] = InitPlaylist()
+	return nil
+}
+
+// Delete removes the playlist called name, which mustn't be the active one.
+func (s *PlaylistSet) Delete(name string) error {
+	if err := s.checkExists(name); err != nil {
+		return err
+	}
+	if name == s.active {
+		return fmt.Errorf("Can't delete the active playlist")
+	}
+	delete(s.playlists, name)
+	return nil
+}
+
+// Rename renames the playlist called from to to. Renaming the active playlist leaves it active.
+func (s *PlaylistSet) Rename(from, to string) error {
+	if err := s.checkExists(from); err != nil {
+		return err
+	}
+	if err := s.checkNew(to); err != nil {
+		return err
+	}
+	s.playlists[to] = s.playlists[from]
+	delete(s.playlists, from)
+	if s.active == from {
+		s.active = to
+	}
+	return nil
+}
+
+// Copy makes a new playlist called to with the items of the one called from.
+func (s *PlaylistSet) Copy(from, to string) error {
+	if err := s.checkExists(from); err != nil {
+		return err
+	}
+	if err := s.checkNew(to); err != nil {
+		return err
+	}
+	s.playlists[to] = s.playlists[from].Copy()
+	return nil
+}
+
+// Activate makes the playlist called name the active one.
+// The previously active playlist's selection is cleared, as it no longer drives anything.
+func (s *PlaylistSet) Activate(name string) error {
+	if err := s.checkExists(name); err != nil {
+		return err
+	}
+	if name != s.active {
+		s.playlists[s.active].selection = -1
+		s.active = name
+	}
+	return nil
+}
+
+// Locate finds which playlist item is in, and where, or gives "" and -1 if it isn't in any.
+// Copied playlists share hashes, so this goes by the item itself.
+func (s *PlaylistSet) Locate(item *PlaylistItem) (name string, i int) {
+	for name, pl := range s.playlists {
+		if i := pl.Find(item.Hash); i >= 0 && pl.items[i] == item {
+			return name, i
+		}
+	}
+	return "", -1
+}
+
+func (s *PlaylistSet) checkExists(name string) error {
+	if _, ok := s.playlists[name]; !ok {
+		return fmt.Errorf("No such playlist")
+	}
+	return nil
+}
+
+func (s *PlaylistSet) checkNew(name string) error {
+	if name == "" {
+		return fmt.Errorf("Bad playlist name")
+	}
+	if _, ok := s.playlists[name]; ok {
+		return fmt.Errorf("Playlist already exists")
+	}
+	return nil
+}
+
+// Copy makes a fresh copy of the playlist, with nothing selected and nothing played yet.
+func (pl *Playlist) Copy() *Playlist {
+	items := make([]*PlaylistItem, len(pl.items))
+	for i, item := range pl.items {
+		c := *item
+		c.Meta = nil
+		for k, v := range item.Meta {
+			c.SetMeta(k, v)
+		}
+		c.State, c.Started, c.Ended = ItemQueued, time.Time{}, time.Time{}
+		items[i] = &c
+	}
+	return makePlaylist(items, -1)
+}
+
+// Marks msg, about the playlist called name, as being about that playlist if it isn't the active one,
+// by giving @name as its first argument, as requests do to pick a playlist.
+func (h *hub) forPlaylist(name string, msg *baps3.Message) *baps3.Message {
+	if active, _ := h.pls.Active(); name == active {
+		return msg
+	}
+	marked := baps3.NewMessage(msg.Word()).AddArg("@" + name)
+	for _, arg := range msg.Args() {
+		marked.AddArg(arg)
+	}
+	return marked
+}
+
+// Finds the item a result from off the hub loop is for, by its hash and data, whichever playlist it's in.
+// The active playlist is looked in first. Gives i < 0 if the item's gone, or been replaced, in the meantime.
+func (h *hub) findItem(hash string, data string) (name string, pl *Playlist, i int) {
+	active, _ := h.pls.Active()
+	for _, name := range append([]string{active}, h.pls.Names()...) {
+		pl := h.pls.Get(name)
+		if i := pl.Find(hash); i >= 0 && pl.items[i].Data == data {
+			return name, pl, i
+		}
+	}
+	return "", nil, -1
+}
+
+// Handles a request naming a playlist to act on, with a first argument of @name, by having plFunc act on that one.
+// Its responses are marked as being about that playlist.
+// Only requests that don't touch the downstream service when acting on an unselected playlist can do this.
+func (h *hub) processTargeted(plFunc func(*hub, *Playlist, baps3.Message) []*baps3.Message, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	name := strings.TrimPrefix(args[0], "@")
+	pl := h.pls.Get(name)
+	if pl == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No such playlist"))
+	}
+	stripped := baps3.NewMessage(req.Word())
+	for _, arg := range args[1:] {
+		stripped.AddArg(arg)
+	}
+
+	resps = plFunc(h, pl, *stripped)
+	for i, resp := range resps {
+		if resp.Word() != baps3.RsFail && resp.Word() != baps3.RsWhat {
+			resps[i] = h.forPlaylist(name, resp)
+		}
+	}
+	return
+}
+
+func (h *hub) makeRsPlaylist(name string) *baps3.Message {
+	return baps3.NewMessage(RsPlaylist).AddArg(name).AddArg(strconv.Itoa(len(h.pls.Get(name).items)))
+}
+
+func (h *hub) makeRsActivePlaylist() *baps3.Message {
+	name, _ := h.pls.Active()
+	return baps3.NewMessage(RsActivePlaylist).AddArg(name)
+}
+
+// Collates the responses listing every playlist, then which is active.
+func (h *hub) makePlaylistsResponses() (msgs []*baps3.Message) {
+	for _, name := range h.pls.Names() {
+		msgs = append(msgs, h.makeRsPlaylist(name))
+	}
+	return append(msgs, h.makeRsActivePlaylist())
+}
+
+func (h *hub) processReqPlaylists(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 0 {
+		return makeBadCommandMsgs()
+	}
+	return h.makePlaylistsResponses()
+}
+
+func (h *hub) processReqCreatePlaylist(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	name, _ := req.Arg(0)
+	if err := h.pls.Create(name); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, h.makeRsPlaylist(name))
+}
+
+func (h *hub) processReqDeletePlaylist(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	name, _ := req.Arg(0)
+	if err := h.pls.Delete(name); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, baps3.NewMessage(RsDeletePlaylist).AddArg(name))
+}
+
+func (h *hub) processReqRenamePlaylist(req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 2 {
+		return makeBadCommandMsgs()
+	}
+	if err := h.pls.Rename(args[0], args[1]); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, baps3.NewMessage(RsRenamePlaylist).AddArg(args[0]).AddArg(args[1]))
+}
+
+func (h *hub) processReqCopyPlaylist(req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 2 {
+		return makeBadCommandMsgs()
+	}
+	if err := h.pls.Copy(args[0], args[1]); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, h.makeRsPlaylist(args[1]))
+}
+
+// Switches the running order over to another playlist.
+// Whatever was playing from the old one is ejected, and the new one starts with nothing selected.
+func (h *hub) activatePlaylist(name string) error {
+	oldSelected := h.pl.Selected()
+	if err := h.pls.Activate(name); err != nil {
+		return err
+	}
+	_, h.pl = h.pls.Active()
+	h.leaveItem(oldSelected) // Old playlist's selection has been cleared, and it's no longer active
+	log.Println("Activated playlist", name)
+	if h.downstreamState.State != baps3.StEjected {
+		h.cReqCh <- *baps3.NewMessage(baps3.RqEject)
+	}
+	h.noteHeld() // Until something's picked from the new one
+	h.persist()
+	h.analyseAll()
+	return nil
+}
+
+// Collates the responses telling clients which playlist is now active, and what's in it.
+func (h *hub) makeActivatedResponses() (msgs []*baps3.Message) {
+	msgs = append(msgs, h.makeRsActivePlaylist())
+	msgs = append(msgs, h.makeListResponses(h.pl)...)
+	return append(msgs, makeRsSelect(h.pl))
+}
+
+func (h *hub) processReqActivatePlaylist(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	name, _ := req.Arg(0)
+	if active, _ := h.pls.Active(); name == active {
+		return append(resps, h.makeRsActivePlaylist())
+	}
+	if err := h.activatePlaylist(name); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	return h.makeActivatedResponses()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestPlaylistSet(t *testing.T) {
+	s := InitPlaylistSet()
+	mainPl := s.Get(DefaultPlaylistName)
+	mainPl.items = []*PlaylistItem{
+		&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, State: ItemPlayed, Started: time.Unix(1000, 0), Meta: map[string]string{"artist": "Boney M."}},
+	}
+	mainPl.reindex(0)
+	mainPl.selection = 0
+
+	cases := []struct {
+		op      func() error
+		wantErr bool
+	}{
+		{func() error { return s.Create("backup") }, false},
+		// Test creating a playlist that exists
+		{func() error { return s.Create("backup") }, true},
+		// Test creating a playlist with no name
+		{func() error { return s.Create("") }, true},
+		{func() error { return s.Copy(DefaultPlaylistName, "overrun") }, false},
+		// Test copying over an existing playlist
+		{func() error { return s.Copy(DefaultPlaylistName, "backup") }, true},
+		// Test copying a missing playlist
+		{func() error { return s.Copy("nope", "fillers") }, true},
+		{func() error { return s.Rename("overrun", "fillers") }, false},
+		// Test renaming a missing playlist
+		{func() error { return s.Rename("overrun", "spare") }, true},
+		// Test deleting the active playlist
+		{func() error { return s.Delete(DefaultPlaylistName) }, true},
+		{func() error { return s.Delete("backup") }, false},
+		{func() error { return s.Activate("fillers") }, false},
+		// Test activating a missing playlist
+		{func() error { return s.Activate("backup") }, true},
+		// Test renaming the active playlist
+		{func() error { return s.Rename("fillers", "overrun") }, false},
+	}
+	for caseno, c := range cases {
+		if err := c.op(); (err != nil) != c.wantErr {
+			t.Errorf("TestPlaylistSet: case %d returned err %v, want err %v", caseno, err, c.wantErr)
+		}
+	}
+
+	if names := s.Names(); !reflect.DeepEqual(names, []string{DefaultPlaylistName, "overrun"}) {
+		t.Errorf("TestPlaylistSet: names == %q, want [main overrun]", names)
+	}
+	if name, pl := s.Active(); name != "overrun" || pl != s.Get("overrun") {
+		t.Errorf("TestPlaylistSet: active == %q, want overrun", name)
+	}
+	if mainPl.HasSelection() {
+		t.Errorf("TestPlaylistSet: deactivated playlist still has selection %d", mainPl.selection)
+	}
+
+	// Copies start afresh, and don't share items
+	c := s.Get("overrun").items[0]
+	if c == mainPl.items[0] || c.State != ItemQueued || !c.Started.IsZero() || c.Meta["artist"] != "Boney M." {
+		t.Errorf("TestPlaylistSet: copied item == %v", c)
+	}
+	c.SetMeta("artist", "")
+	if mainPl.items[0].Meta["artist"] != "Boney M." {
+		t.Errorf("TestPlaylistSet: changing copy's metadata changed original")
+	}
+
+	// Copies share hashes, so items are located by identity
+	if name, i := s.Locate(c); name != "overrun" || i != 0 {
+		t.Errorf("TestPlaylistSet: copied item located at %q %d, want overrun 0", name, i)
+	}
+	if name, i := s.Locate(mainPl.items[0]); name != DefaultPlaylistName || i != 0 {
+		t.Errorf("TestPlaylistSet: original item located at %q %d, want main 0", name, i)
+	}
+	if _, i := s.Locate(&PlaylistItem{Hash: "aaa"}); i != -1 {
+		t.Errorf("TestPlaylistSet: unlisted item located at %d, want -1", i)
+	}
+}
+
+func TestProcessTargeted(t *testing.T) {
+	cases := []struct {
+		args         []string
+		wantResps    [][]string
+		wantActive   []string
+		wantOverrun  []string
+		wantSelected int
+	}{
+		{[]string{"@overrun", "bbb"}, [][]string{{"DEQUEUE", "@overrun", "0", "bbb"}}, []string{"aaa", "bbb"}, []string{"ccc"}, 1},
+		{[]string{"@main", "bbb"}, [][]string{{"SELECT"}, {"DEQUEUE", "1", "bbb"}}, []string{"aaa"}, []string{"bbb", "ccc"}, -1},
+		// Test a playlist that isn't there, and a hash that isn't in the one named
+		{[]string{"@nope", "bbb"}, [][]string{{"FAIL", "No such playlist"}}, []string{"aaa", "bbb"}, []string{"bbb", "ccc"}, 1},
+		{[]string{"@overrun", "aaa"}, [][]string{{"FAIL", "Hash not found"}}, []string{"aaa", "bbb"}, []string{"bbb", "ccc"}, 1},
+	}
+	for caseno, c := range cases {
+		h := &hub{pls: InitPlaylistSet()}
+		_, h.pl = h.pls.Active()
+		h.pl.Enqueue(0, &PlaylistItem{Data: "Travel news", Hash: "aaa", Type: ItemText})
+		h.pl.Enqueue(1, &PlaylistItem{Data: "rasputin.mp3", Hash: "bbb", Type: ItemFile})
+		h.pl.selection = 1
+		h.pls.Create("overrun")
+		overrun := h.pls.Get("overrun")
+		overrun.Enqueue(0, &PlaylistItem{Data: "rasputin.mp3", Hash: "bbb", Type: ItemFile})
+		overrun.Enqueue(1, &PlaylistItem{Data: "mabaker.mp3", Hash: "ccc", Type: ItemFile})
+		req := baps3.NewMessage(baps3.RqDequeue)
+		for _, arg := range c.args {
+			req.AddArg(arg)
+		}
+
+		var resps [][]string
+		for _, resp := range h.processTargeted(TARGETABLE_REQS[baps3.RqDequeue], *req) {
+			resps = append(resps, msgStrings(resp))
+		}
+		if !reflect.DeepEqual(resps, c.wantResps) {
+			t.Errorf("TestProcessTargeted: case %d responded %v, want %v", caseno, resps, c.wantResps)
+		}
+		if _, active := h.pls.Active(); h.pl != active {
+			t.Errorf("TestProcessTargeted: case %d left h.pl not the active playlist", caseno)
+		}
+		for name, want := range map[string][]string{DefaultPlaylistName: c.wantActive, "overrun": c.wantOverrun} {
+			var hashes []string
+			for _, item := range h.pls.Get(name).items {
+				hashes = append(hashes, item.Hash)
+			}
+			if !reflect.DeepEqual(hashes, want) {
+				t.Errorf("TestProcessTargeted: case %d left %s with %v, want %v", caseno, name, hashes, want)
+			}
+		}
+		if h.pl.selection != c.wantSelected {
+			t.Errorf("TestProcessTargeted: case %d left selection %d, want %d", caseno, h.pl.selection, c.wantSelected)
+		}
+	}
+}
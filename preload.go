@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// How far warming up the next file item has got.
+const (
+	PreloadLoading = "loading"
+	PreloadReady   = "ready"
+	PreloadFailed  = "failed"
+)
+
+// The outcome of warming up an item's file.
+type preloadResult struct {
+	hash string
+	data string
+	err  error
+}
+
+// Reads the whole of the file at path, so it's in the page cache by the time the downstream service loads it,
+// sending the outcome down resCh.
+// Meant to be run in its own goroutine.
+func preloadFile(hash string, data string, path string, resCh chan<- preloadResult) {
+	res := preloadResult{hash: hash, data: data}
+	f, err := os.Open(path)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, f)
+		f.Close()
+	}
+	res.err = err
+	resCh <- res
+}
+
+// Gives the index of the item the running order will move on to next, or -1 if there isn't one.
+func (h *hub) nextIdx() int {
+	i := h.pl.Next()
+	if i < 0 && h.repeatMode == RepeatAll && h.pl.HasSelection() {
+		i = h.pl.First()
+	}
+	return i
+}
+
+func (h *hub) makeRsPreload() *baps3.Message {
+	return baps3.NewMessage(RsPreload).AddArg(strconv.Itoa(h.pl.Find(h.preloadHash))).AddArg(h.preloadHash).AddArg(h.preloadState)
+}
+
+// Starts warming up the next file item once the selected one is playing, if it isn't already warm.
+// Forgets about the last one warmed up if it's no longer next.
+func (h *hub) updatePreload() {
+	if h.downstreamState.State != baps3.StPlaying {
+		return
+	}
+	i := h.nextIdx()
+	if i < 0 || !h.pl.items[i].IsFile() {
+		h.preloadHash, h.preloadState = "", ""
+		return
+	}
+	item := h.pl.items[i]
+	if item.Hash == h.preloadHash {
+		return
+	}
+	h.preloadHash = item.Hash
+	path, reason := h.validator.Resolve(item.Data)
+	if reason != "" {
+		h.preloadState = PreloadFailed
+	} else {
+		h.preloadState = PreloadLoading
+		go preloadFile(item.Hash, item.Data, path, h.preloadCh)
+	}
+	h.broadcast(*h.makeRsPreload())
+}
+
+// Notes that the next file item has been warmed up, if it's still next.
+func (h *hub) processPreloadResult(res preloadResult) {
+	i := h.pl.Find(res.hash)
+	if res.hash != h.preloadHash || i < 0 || h.pl.items[i].Data != res.data {
+		return // Moved on in the meantime
+	}
+	h.preloadState = PreloadReady
+	if res.err != nil {
+		log.Println("Error preloading", res.data, ":", res.err.Error())
+		h.preloadState = PreloadFailed
+	}
+	h.broadcast(*h.makeRsPreload())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestPreloadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rasputin.mp3")
+	if err = ioutil.WriteFile(path, []byte("ra ra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resCh := make(chan preloadResult, 1)
+	preloadFile("aaa", "library:rasputin.mp3", path, resCh)
+	if res := <-resCh; res.hash != "aaa" || res.data != "library:rasputin.mp3" || res.err != nil {
+		t.Errorf("TestPreloadFile: result == %v, want aaa library:rasputin.mp3 <nil>", res)
+	}
+
+	preloadFile("bbb", "library:mabaker.mp3", filepath.Join(dir, "mabaker.mp3"), resCh)
+	if res := <-resCh; res.err == nil {
+		t.Errorf("TestPreloadFile: missing file returned nil when should be err")
+	}
+}
+
+func TestUpdatePreload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		state       baps3.State
+		sel         int
+		repeatMode  RepeatMode
+		nextType    ItemType
+		nextGone    bool
+		preloaded   string
+		wantHash    string
+		wantState   string
+		wantPreload bool
+	}{
+		{baps3.StPlaying, 0, RepeatNone, ItemFile, false, "", "bbb", PreloadLoading, true},
+		// Test waiting until something's playing
+		{baps3.StStopped, 0, RepeatNone, ItemFile, false, "", "", "", false},
+		// Test the next item being warmed up already
+		{baps3.StPlaying, 0, RepeatNone, ItemFile, false, "bbb", "bbb", PreloadReady, false},
+		// Test a next item with nothing to warm up, or whose file has gone
+		{baps3.StPlaying, 0, RepeatNone, ItemLink, false, "bbb", "", "", false},
+		{baps3.StPlaying, 0, RepeatNone, ItemFile, true, "", "bbb", PreloadFailed, true},
+		// Test the end of the running order, with and without wrapping round
+		{baps3.StPlaying, 1, RepeatNone, ItemFile, false, "bbb", "", "", false},
+		{baps3.StPlaying, 1, RepeatAll, ItemFile, false, "", "aaa", PreloadLoading, true},
+	}
+	for caseno, c := range cases {
+		next := &PlaylistItem{Data: "library:mabaker.mp3", Hash: "bbb", Type: c.nextType}
+		if c.nextType == ItemLink {
+			next.Data, next.Meta = "Travel news", map[string]string{"duration": "60000000"}
+		}
+		items := []*PlaylistItem{{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile}, next}
+		h, _ := newTestHub(t, dir, items, c.sel)
+		if c.nextGone {
+			if err = os.Remove(filepath.Join(dir, "mabaker.mp3")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.downstreamState.State, h.repeatMode = c.state, c.repeatMode
+		h.preloadCh = make(chan preloadResult, 1)
+		if c.preloaded != "" {
+			h.preloadHash, h.preloadState = c.preloaded, PreloadReady
+		}
+		resCh := addTestClient(h)
+
+		h.updatePreload()
+		if h.preloadHash != c.wantHash || h.preloadState != c.wantState {
+			t.Errorf("TestUpdatePreload: case %d warming %q %q, want %q %q", caseno, h.preloadHash, h.preloadState, c.wantHash, c.wantState)
+		}
+		if preload := reflect.DeepEqual(sentWords(resCh), []string{"PRELOAD"}); preload != c.wantPreload {
+			t.Errorf("TestUpdatePreload: case %d told clients %v, want %v", caseno, preload, c.wantPreload)
+		}
+		if c.wantState == PreloadLoading {
+			if res := <-h.preloadCh; res.hash != c.wantHash || res.err != nil {
+				t.Errorf("TestUpdatePreload: case %d warmed up %v, want %s", caseno, res, c.wantHash)
+			}
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// The words listd adds to the protocol, which baps3-go doesn't know about.
+// Their values are well clear of baps3-go's own, and their names are looked up here rather than there.
+const localWordBase baps3.MessageWord = 1000
+
+const (
+	// - Requests
+	RqActivatePlaylist = localWordBase + iota
+	RqAsRun
+	RqAutoFit
+	RqBrowse
+	RqClearAlarm
+	RqCopyPlaylist
+	RqCreatePlaylist
+	RqCue
+	RqDeletePlaylist
+	RqDeleteTemplate
+	RqDroppable
+	RqEndTime
+	RqFade
+	RqGain
+	RqInstantiate
+	RqPlaylists
+	RqRenamePlaylist
+	RqRepeat
+	RqSaveTemplate
+	RqSchedule
+	RqSearch
+	RqSetMeta
+	RqStopAfter
+	RqTemplates
+
+	// - Responses
+	RsActivePlaylist
+	RsAlarm
+	RsAsRun
+	RsAutoFit
+	RsBacktime
+	RsCountdown
+	RsCue
+	RsCuedOut
+	RsDeletePlaylist
+	RsDeleteTemplate
+	RsDrift
+	RsDroppable
+	RsDropped
+	RsEndTime
+	RsFade
+	RsFileError
+	RsGain
+	RsIntro
+	RsItemState
+	RsLinkCountdown
+	RsLoudness
+	RsMeta
+	RsMissed
+	RsOutro
+	RsPlaylist
+	RsPreload
+	RsPrimary
+	RsRenamePlaylist
+	RsRepeat
+	RsResult
+	RsResults
+	RsSchedule
+	RsStopAfter
+	RsTargetEnd
+	RsTemplate
+)
+
+var localWordStrings = map[baps3.MessageWord]string{
+	RqActivatePlaylist: "activateplaylist",
+	RqAsRun:            "asrun",
+	RqAutoFit:          "autofit",
+	RqBrowse:           "browse",
+	RqClearAlarm:       "clearalarm",
+	RqCopyPlaylist:     "copyplaylist",
+	RqCreatePlaylist:   "createplaylist",
+	RqCue:              "cue",
+	RqDeletePlaylist:   "deleteplaylist",
+	RqDeleteTemplate:   "deletetemplate",
+	RqDroppable:        "droppable",
+	RqEndTime:          "endtime",
+	RqFade:             "fade",
+	RqGain:             "gain",
+	RqInstantiate:      "instantiate",
+	RqPlaylists:        "playlists",
+	RqRenamePlaylist:   "renameplaylist",
+	RqRepeat:           "repeat",
+	RqSaveTemplate:     "savetemplate",
+	RqSchedule:         "schedule",
+	RqSearch:           "search",
+	RqSetMeta:          "setmeta",
+	RqStopAfter:        "stopafter",
+	RqTemplates:        "templates",
+
+	RsActivePlaylist: "ACTIVEPLAYLIST",
+	RsAlarm:          "ALARM",
+	RsAsRun:          "ASRUN",
+	RsAutoFit:        "AUTOFIT",
+	RsBacktime:       "BACKTIME",
+	RsCountdown:      "COUNTDOWN",
+	RsCue:            "CUE",
+	RsCuedOut:        "CUEDOUT",
+	RsDeletePlaylist: "DELETEPLAYLIST",
+	RsDeleteTemplate: "DELETETEMPLATE",
+	RsDrift:          "DRIFT",
+	RsDroppable:      "DROPPABLE",
+	RsDropped:        "DROPPED",
+	RsEndTime:        "ENDTIME",
+	RsFade:           "FADE",
+	RsFileError:      "FILEERROR",
+	RsGain:           "GAIN",
+	RsIntro:          "INTRO",
+	RsItemState:      "ITEMSTATE",
+	RsLinkCountdown:  "LINKCOUNTDOWN",
+	RsLoudness:       "LOUDNESS",
+	RsMeta:           "META",
+	RsMissed:         "MISSED",
+	RsOutro:          "OUTRO",
+	RsPlaylist:       "PLAYLIST",
+	RsPreload:        "PRELOAD",
+	RsPrimary:        "PRIMARY",
+	RsRenamePlaylist: "RENAMEPLAYLIST",
+	RsRepeat:         "REPEAT",
+	RsResult:         "RESULT",
+	RsResults:        "RESULTS",
+	RsSchedule:       "SCHEDULE",
+	RsStopAfter:      "STOPAFTER",
+	RsTargetEnd:      "TARGETEND",
+	RsTemplate:       "TEMPLATE",
+}
+
+// The features listd adds, likewise; some of these are the downstream service's, such as Gain and Fade.
+const localFeatureBase baps3.Feature = 1000
+
+const (
+	FtAlarm = localFeatureBase + iota
+	FtAsRun
+	FtFade
+	FtGain
+	FtLibrary
+	FtNamedPlaylists
+	FtPlaylistBreaks
+	FtPlaylistCues
+	FtPlaylistEndTime
+	FtPlaylistFileErrors
+	FtPlaylistItemStates
+	FtPlaylistLevels
+	FtPlaylistLinks
+	FtPlaylistLoudness
+	FtPlaylistMeta
+	FtPlaylistNotes
+	FtPlaylistRepeat
+	FtPlaylistSchedule
+	FtPlaylistStopAfter
+	FtPlaylistTimedLinks
+	FtPlaylistTiming
+	FtPlaylistURLs
+	FtPreload
+	FtReplication
+	FtTemplates
+)
+
+var localFeatureStrings = map[baps3.Feature]string{
+	FtAlarm:              "Alarm",
+	FtAsRun:              "AsRun",
+	FtFade:               "Fade",
+	FtGain:               "Gain",
+	FtLibrary:            "Library",
+	FtNamedPlaylists:     "NamedPlaylists",
+	FtPlaylistBreaks:     "Playlist.Breaks",
+	FtPlaylistCues:       "Playlist.Cues",
+	FtPlaylistEndTime:    "Playlist.EndTime",
+	FtPlaylistFileErrors: "Playlist.FileErrors",
+	FtPlaylistItemStates: "Playlist.ItemStates",
+	FtPlaylistLevels:     "Playlist.Levels",
+	FtPlaylistLinks:      "Playlist.Links",
+	FtPlaylistLoudness:   "Playlist.Loudness",
+	FtPlaylistMeta:       "Playlist.Meta",
+	FtPlaylistNotes:      "Playlist.Notes",
+	FtPlaylistRepeat:     "Playlist.Repeat",
+	FtPlaylistSchedule:   "Playlist.Schedule",
+	FtPlaylistStopAfter:  "Playlist.StopAfter",
+	FtPlaylistTimedLinks: "Playlist.TimedLinks",
+	FtPlaylistTiming:     "Playlist.Timing",
+	FtPlaylistURLs:       "Playlist.URLs",
+	FtPreload:            "Preload",
+	FtReplication:        "Replication",
+	FtTemplates:          "Templates",
+}
+
+// Gives the name of word, whether it's one of listd's or one of baps3-go's.
+func wordString(word baps3.MessageWord) string {
+	if s, ok := localWordStrings[word]; ok {
+		return s
+	}
+	return word.String()
+}
+
+// Gives the name of ft, whether it's one of listd's or one of baps3-go's.
+func featureString(ft baps3.Feature) string {
+	if s, ok := localFeatureStrings[ft]; ok {
+		return s
+	}
+	return ft.String()
+}
+
+// Converts a tokenised line into a message, knowing about listd's words as well as baps3-go's.
+func lineToMessage(line []string) (*baps3.Message, error) {
+	if len(line) > 0 {
+		for word, s := range localWordStrings {
+			if s == line[0] {
+				msg := baps3.NewMessage(word)
+				for _, arg := range line[1:] {
+					msg.AddArg(arg)
+				}
+				return msg, nil
+			}
+		}
+	}
+	return baps3.LineToMessage(line)
+}
+
+// Packs msg into a line to send, knowing about listd's words as well as baps3-go's.
+// Each argument is single-quoted, with any single quotes in it closed, escaped and reopened, as baps3-go does.
+func packMessage(msg baps3.Message) ([]byte, error) {
+	if msg.Word() == baps3.BadWord {
+		return nil, fmt.Errorf("Can't pack a bad word")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(wordString(msg.Word()))
+	for _, arg := range msg.Args() {
+		buf.WriteString(" '")
+		buf.WriteString(strings.Replace(arg, "'", `'\''`, -1))
+		buf.WriteByte('\'')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Makes a FEATURES message listing features, which may include listd's own.
+func makeFeaturesMessage(features baps3.FeatureSet) *baps3.Message {
+	names := make([]string, 0, len(features))
+	for ft := range features {
+		names = append(names, featureString(ft))
+	}
+	sort.Strings(names)
+	msg := baps3.NewMessage(baps3.RsFeatures)
+	for _, name := range names {
+		msg.AddArg(name)
+	}
+	return msg
+}
+
+// Adds any of listd's features named in a FEATURES message to features, as baps3-go drops those it doesn't know.
+func addLocalFeatures(features baps3.FeatureSet, msg baps3.Message) {
+	for _, arg := range msg.Args() {
+		for ft, s := range localFeatureStrings {
+			if s == arg {
+				features.AddFeature(ft)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestLocalWords(t *testing.T) {
+	seen := make(map[string]bool)
+	for word, s := range localWordStrings {
+		if seen[s] {
+			t.Errorf("TestLocalWords: %q used twice", s)
+		}
+		seen[s] = true
+
+		msg, err := lineToMessage([]string{s, "0", "aaa"})
+		if err != nil {
+			t.Errorf("TestLocalWords: lineToMessage(%q) returned err (%s)", s, err.Error())
+			continue
+		}
+		if msg.Word() != word || !reflect.DeepEqual(msg.Args(), []string{"0", "aaa"}) {
+			t.Errorf("TestLocalWords: lineToMessage(%q) == %v %v, want %v [0 aaa]", s, msg.Word(), msg.Args(), word)
+		}
+		if wordString(word) != s {
+			t.Errorf("TestLocalWords: wordString(%v) == %q, want %q", word, wordString(word), s)
+		}
+
+		data, err := packMessage(*baps3.NewMessage(word).AddArg("0").AddArg("it's here"))
+		if want := s + ` '0' 'it'\''s here'` + "\n"; err != nil || string(data) != want {
+			t.Errorf("TestLocalWords: packMessage(%q) == %q, want %q", s, data, want)
+		}
+	}
+}
+
+func TestAddLocalFeatures(t *testing.T) {
+	msg := baps3.NewMessage(baps3.RsFeatures).AddArg("Nonsense")
+	want := make(baps3.FeatureSet)
+	for ft, s := range localFeatureStrings {
+		msg.AddArg(s)
+		want.AddFeature(ft)
+	}
+	features := make(baps3.FeatureSet)
+	addLocalFeatures(features, *msg)
+	if !reflect.DeepEqual(features, want) {
+		t.Errorf("TestAddLocalFeatures: features == %v, want %v", features, want)
+	}
+}
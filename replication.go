@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// How many updates can be waiting for a slow standby before it's cut off.
+const replicaBacklog = 64
+
+// How many times a standby tries to reach its primary, a takeover time apart, before taking over.
+// This lets the two be started in either order.
+const connectAttempts = 5
+
+// How long to wait after failing to accept a standby before trying again.
+const acceptRetry = time.Second
+
+// One line of the replication stream a primary listd sends its standbys, as JSON.
+// Playlists are only sent when they've changed; the rest is sent every time, so it doubles as a heartbeat.
+//
+// Each takeover starts a new term. If the standby is only cut off from the primary, rather than the primary
+// being gone, both end up primary (split brain), each playing out and taking requests on its own, and their
+// playlists drift apart. Having taken over, a listd keeps trying to reach its old primary, and once the two
+// can talk again, whichever has the older term steps down, ejecting whatever it had loaded, and follows the
+// other, taking on its playlists. Changes made to the stepped-down one in the meantime are lost.
+// This needs both to stream to standbys (--replicationport), as that's how they reach each other.
+type replicationUpdate struct {
+	Primary     string            // Where clients should connect to reach the primary
+	Replication string            // Where standbys should connect to follow the primary
+	Term        int               // Which takeover the primary is from
+	Playlists   *savedPlaylistSet `json:",omitempty"`
+	Selected    string            // Hash of the selected item, if any
+	Playing     bool
+	Position    time.Duration // How far into the selected item playback has got
+	AutoAdvance bool
+	RepeatMode  RepeatMode
+	TargetEnd   time.Time // When the playlist should end, if set
+	AutoFit     bool
+}
+
+// Streams updates to the standby listds connected to it.
+// Anything a standby sends back, which only a primary that's taken over from this one does, comes out of Superseded.
+type replicator struct {
+	Superseded chan replicationUpdate
+
+	sync.Mutex
+	replicas map[net.Conn]chan []byte
+	full     []byte // Last update with playlists in, which new standbys start from
+}
+
+func newReplicator() *replicator {
+	return &replicator{
+		Superseded: make(chan replicationUpdate, 1),
+		replicas:   make(map[net.Conn]chan []byte),
+	}
+}
+
+// Listen accepts standbys on addr, in the background. Returns the address actually listened on.
+// Accepting stops if the listener fails for good.
+func (r *replicator) Listen(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					log.Println("Error accepting standby:", err.Error())
+					time.Sleep(acceptRetry)
+					continue
+				}
+				log.Println("No longer accepting standbys:", err.Error())
+				return
+			}
+			log.Println("New standby from", conn.RemoteAddr())
+			ch := make(chan []byte, replicaBacklog)
+			r.Lock()
+			if r.full != nil {
+				ch <- r.full
+			}
+			r.replicas[conn] = ch
+			r.Unlock()
+			go r.write(conn, ch)
+			go r.read(conn)
+		}
+	}()
+	return l.Addr(), nil
+}
+
+// Sends each line from ch to a standby until the connection fails or the standby is cut off.
+func (r *replicator) write(conn net.Conn, ch <-chan []byte) {
+	defer conn.Close()
+	for line := range ch {
+		if _, err := conn.Write(line); err != nil {
+			log.Println("Lost standby", conn.RemoteAddr(), ":", err.Error())
+			r.drop(conn)
+			return
+		}
+	}
+}
+
+// Passes on anything a standby sends back until the connection closes.
+func (r *replicator) read(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var u replicationUpdate
+		if err = json.Unmarshal(line, &u); err != nil {
+			log.Println("Error decoding reply from standby:", err.Error())
+			continue
+		}
+		select {
+		case r.Superseded <- u:
+		default: // Already has one to act on
+		}
+	}
+}
+
+func (r *replicator) drop(conn net.Conn) {
+	r.Lock()
+	defer r.Unlock()
+	if ch, ok := r.replicas[conn]; ok {
+		close(ch)
+		delete(r.replicas, conn)
+	}
+}
+
+// Send queues u for every standby, cutting off any too far behind to catch up.
+func (r *replicator) Send(u replicationUpdate) {
+	line, err := json.Marshal(u)
+	if err != nil {
+		log.Println("Error encoding replication update:", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	r.Lock()
+	defer r.Unlock()
+	if u.Playlists != nil {
+		r.full = line
+	}
+	for conn, ch := range r.replicas {
+		select {
+		case ch <- line:
+		default:
+			log.Println("Standby", conn.RemoteAddr(), "too far behind, cutting off")
+			close(ch)
+			delete(r.replicas, conn)
+		}
+	}
+}
+
+// Follows the replication stream of the primary at addr, sending the updates down updCh,
+// and anything from replyCh back up it.
+// Closes updCh once the primary can't be reached after connectAttempts tries, or has gone quiet for longer than timeout,
+// or once stop is closed, as when following a different primary.
+func followPrimary(addr string, timeout time.Duration, updCh chan<- replicationUpdate, replyCh <-chan replicationUpdate, stop <-chan struct{}) {
+	defer close(updCh)
+	var conn net.Conn
+	var err error
+	for i := 0; i < connectAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(timeout):
+			case <-stop:
+				return
+			}
+		}
+		if conn, err = net.DialTimeout("tcp", addr, timeout); err == nil {
+			break
+		}
+		log.Println("Can't reach primary:", err.Error())
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case u := <-replyCh:
+				line, err := json.Marshal(u)
+				if err != nil {
+					continue
+				}
+				if _, err = conn.Write(append(line, '\n')); err != nil {
+					return
+				}
+			case <-stop:
+				conn.Close() // Stop waiting on the primary
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			log.Println("Lost primary:", err.Error())
+			return
+		}
+		var u replicationUpdate
+		if err = json.Unmarshal(line, &u); err != nil {
+			log.Println("Error decoding replication update:", err.Error())
+			return
+		}
+		select {
+		case updCh <- u:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Starts following the primary streaming from addr, or, once taken over, watching for it coming back.
+// Stops following whichever primary was followed before.
+func (h *hub) followPrimary(addr string) {
+	if h.followStop != nil {
+		close(h.followStop)
+	}
+	h.primaryAddr = addr
+	h.replCh = make(chan replicationUpdate)
+	h.replyCh = make(chan replicationUpdate, 1)
+	h.followStop = make(chan struct{})
+	go followPrimary(addr, h.takeoverTimeout, h.replCh, h.replyCh, h.followStop)
+}
+
+// Tells clients where the primary is, if known.
+func (h *hub) makeRsPrimary() *baps3.Message {
+	msg := baps3.NewMessage(RsPrimary)
+	if h.primary != "" {
+		msg.AddArg(h.primary)
+	}
+	return msg
+}
+
+// Sends the hub's state to any standbys, with the playlists if they've changed.
+func (h *hub) replicate(changed bool) {
+	if h.replicator == nil || h.standby {
+		return
+	}
+	u := replicationUpdate{
+		Primary:     h.primary,
+		Replication: h.replAdvertise,
+		Term:        h.term,
+		Playing:     h.downstreamState.State == baps3.StPlaying,
+		Position:    h.downstreamState.Time,
+		AutoAdvance: h.autoAdvance,
+		RepeatMode:  h.repeatMode,
+		TargetEnd:   h.targetEnd,
+		AutoFit:     h.autoFit,
+	}
+	if changed {
+		saved := h.pls.saved()
+		u.Playlists = &saved
+	}
+	if sel := h.pl.Selected(); sel != nil {
+		u.Selected = sel.Hash
+	}
+	h.replicator.Send(u)
+}
+
+// Brings a standby's state into line with the primary's.
+// Once taken over, updates come from the old primary coming back: if it's from a later term this steps down,
+// otherwise it's told it's been superseded.
+func (h *hub) applyReplication(u replicationUpdate) {
+	if !h.standby {
+		if u.Term <= h.term {
+			select {
+			case h.replyCh <- replicationUpdate{Primary: h.primary, Replication: h.replAdvertise, Term: h.term}:
+			default: // Still telling it
+			}
+			return
+		}
+		h.stepDown(u)
+	}
+	h.term = u.Term
+	if u.Primary != h.primary {
+		h.primary = u.Primary
+		h.broadcast(*h.makeRsPrimary())
+	}
+	h.primaryPlaying, h.primaryPosition = u.Playing, u.Position
+	endChanged := h.applyModes(u)
+
+	changed := false
+	if u.Playlists != nil {
+		data, err := json.Marshal(u.Playlists)
+		if err == nil {
+			var pls *PlaylistSet
+			if pls, err = decodePlaylistSet(data); err == nil {
+				h.pls = pls
+				_, h.pl = pls.Active()
+				changed = true
+			}
+		}
+		if err != nil {
+			log.Println("Error applying replicated playlists:", err.Error())
+		}
+	}
+	if changed || endChanged {
+		h.persist()
+	}
+
+	oldSelection := h.pl.selection
+	h.pl.selection = h.pl.Find(u.Selected)
+	if changed {
+		for _, msg := range h.makeActivatedResponses() {
+			h.broadcast(*msg)
+		}
+	} else if h.pl.selection != oldSelection {
+		h.broadcast(*makeRsSelect(h.pl))
+	}
+}
+
+// Takes on the primary's auto-advance, repeat and show end settings, telling clients of any that changed.
+// Returns true if the show end changed, which is saved with the playlists.
+func (h *hub) applyModes(u replicationUpdate) (endChanged bool) {
+	if u.AutoAdvance != h.autoAdvance {
+		h.autoAdvance = u.AutoAdvance
+		h.broadcast(*h.makeRsAutoAdvance())
+	}
+	if u.RepeatMode != h.repeatMode {
+		h.repeatMode = u.RepeatMode
+		h.broadcast(*h.makeRsRepeat())
+	}
+	if !u.TargetEnd.Equal(h.targetEnd) {
+		h.targetEnd = u.TargetEnd
+		h.broadcast(*h.makeRsTargetEnd())
+		endChanged = true
+	}
+	if u.AutoFit != h.autoFit {
+		h.autoFit = u.AutoFit
+		h.broadcast(*h.makeRsAutoFit())
+		endChanged = true
+	}
+	return
+}
+
+// Deals with the primary's stream ending: a standby takes over, and a primary that's taken over
+// carries on watching for the old primary coming back.
+func (h *hub) lostPrimary() {
+	if h.standby {
+		h.takeOver()
+	}
+	h.followPrimary(h.primaryAddr)
+}
+
+// Makes a standby the primary, once the old primary has gone, starting a new term: it picks up the selected item
+// and, if the primary was playing it, carries on from where it got to.
+func (h *hub) takeOver() {
+	log.Println("Primary gone, taking over")
+	h.standby = false
+	h.term++
+	h.primary = h.advertise
+	h.broadcast(*h.makeRsPrimary())
+	h.lastPlaying = time.Now()
+	h.replicate(true)
+
+	if h.pl.HasSelection() && h.loadSelected() && h.primaryPlaying {
+		sel := h.pl.Selected()
+		if h.primaryPosition > sel.CueIn && h.downstreamHas(baps3.FtSeek) {
+			h.cReqCh <- *baps3.NewMessage(baps3.RqSeek).AddArg(microsStr(h.primaryPosition))
+		}
+		h.cReqCh <- *baps3.NewMessage(baps3.RqPlay)
+	}
+}
+
+// Makes a primary that's been superseded, by one from a later term, a standby for it.
+// Whatever it had loaded is ejected, so only the new primary is heard.
+func (h *hub) stepDown(u replicationUpdate) {
+	if h.standby || u.Term <= h.term {
+		return // Nothing newer
+	}
+	log.Println("Superseded by primary at", u.Primary, ", standing by")
+	h.standby = true
+	h.term = u.Term
+	h.primary = u.Primary
+	h.broadcast(*h.makeRsPrimary())
+	if h.downstreamState.State != baps3.StEjected {
+		h.cReqCh <- *baps3.NewMessage(baps3.RqEject)
+	}
+	if u.Replication != h.primaryAddr {
+		h.followPrimary(u.Replication)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestReplication(t *testing.T) {
+	r := newReplicator()
+	addr, err := r.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := InitPlaylistSet()
+	s.Get(DefaultPlaylistName).Enqueue(0, &PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile})
+	saved := s.saved()
+	full := replicationUpdate{Primary: "studio1:1351", Playlists: &saved, Selected: "aaa"}
+	r.Send(full) // Before the standby connects, so it has to catch up
+
+	updCh := make(chan replicationUpdate)
+	go followPrimary(addr.String(), 200*time.Millisecond, updCh, nil, nil)
+
+	u, ok := <-updCh
+	if !ok {
+		t.Fatalf("TestReplication: standby got nothing")
+	}
+	if u.Primary != full.Primary || u.Selected != "aaa" || u.Playlists == nil {
+		t.Errorf("TestReplication: first update == %v, want %v", u, full)
+	}
+	got, err := decodePlaylistSet(mustMarshal(t, u.Playlists))
+	if err != nil {
+		t.Fatalf("TestReplication: decoding playlists returned err (%s)", err.Error())
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("TestReplication: replicated playlists == %v, want %v", got, s)
+	}
+
+	// Wait for the standby to be registered before sending a heartbeat
+	for {
+		r.Lock()
+		n := len(r.replicas)
+		r.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	beat := replicationUpdate{Primary: "studio1:1351", Selected: "aaa", Playing: true, Position: 5 * time.Second}
+	r.Send(beat)
+	if u = <-updCh; !reflect.DeepEqual(u, beat) {
+		t.Errorf("TestReplication: heartbeat == %v, want %v", u, beat)
+	}
+
+	// Primary goes quiet
+	select {
+	case _, ok = <-updCh:
+		if ok {
+			t.Errorf("TestReplication: got update after primary went quiet")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("TestReplication: standby didn't notice primary going quiet")
+	}
+}
+
+func TestFollowPrimaryRetries(t *testing.T) {
+	// Find a free port, then have the primary start on it after the standby
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	updCh := make(chan replicationUpdate)
+	replyCh := make(chan replicationUpdate, 1)
+	go followPrimary(addr, 200*time.Millisecond, updCh, replyCh, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	r := newReplicator()
+	if _, err = r.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	saved := InitPlaylistSet().saved()
+	r.Send(replicationUpdate{Primary: "studio1:1351", Term: 1, Playlists: &saved}) // Caught up on when the standby connects
+	u, ok := <-updCh
+	if !ok || u.Term != 1 {
+		t.Fatalf("TestFollowPrimaryRetries: standby got %v, %v after primary started late", u, ok)
+	}
+
+	// Test answering a primary that's been taken over from
+	replyCh <- replicationUpdate{Primary: "studio2:1351", Replication: "studio2:1352", Term: 2}
+	select {
+	case u = <-r.Superseded:
+		if u.Term != 2 || u.Replication != "studio2:1352" {
+			t.Errorf("TestFollowPrimaryRetries: primary was told %v, want term 2 from studio2:1352", u)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("TestFollowPrimaryRetries: primary wasn't told it had been superseded")
+	}
+}
+
+func TestApplyReplicationTerms(t *testing.T) {
+	newHub := func(standby bool) *hub {
+		h := &hub{pls: InitPlaylistSet(), term: 2, standby: standby, primary: "studio2:1351", primaryAddr: "studio1:1352"}
+		_, h.pl = h.pls.Active()
+		h.downstreamState.State = baps3.StEjected // Nothing to eject on stepping down
+		h.replyCh = make(chan replicationUpdate, 1)
+		return h
+	}
+	s := InitPlaylistSet()
+	s.Get(DefaultPlaylistName).Enqueue(0, &PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile})
+	saved := s.saved()
+
+	cases := []struct {
+		standby     bool
+		term        int
+		wantStandby bool
+		wantTerm    int
+		wantReply   bool
+		wantApplied bool
+	}{
+		// Test a standby following its primary
+		{true, 2, true, 2, false, true},
+		// Test a primary that's taken over hearing from the old one, which hasn't
+		{false, 1, false, 2, true, false},
+		{false, 2, false, 2, true, false},
+		// Test a primary that's been taken over from itself since
+		{false, 3, true, 3, false, true},
+	}
+	for caseno, c := range cases {
+		h := newHub(c.standby)
+		h.applyReplication(replicationUpdate{Primary: "studio1:1351", Replication: "studio1:1352", Term: c.term, Playlists: &saved, Selected: "aaa"})
+		if h.standby != c.wantStandby || h.term != c.wantTerm {
+			t.Errorf("TestApplyReplicationTerms: case %d left standby %v term %d, want %v %d", caseno, h.standby, h.term, c.wantStandby, c.wantTerm)
+		}
+		if replied := len(h.replyCh) > 0; replied != c.wantReply {
+			t.Errorf("TestApplyReplicationTerms: case %d replied %v, want %v", caseno, replied, c.wantReply)
+		}
+		if applied := h.pl.Find("aaa") >= 0; applied != c.wantApplied {
+			t.Errorf("TestApplyReplicationTerms: case %d applied playlists %v, want %v", caseno, applied, c.wantApplied)
+		}
+	}
+}
+
+func TestApplyModes(t *testing.T) {
+	end := time.Unix(1500000000, 0)
+	cases := []struct {
+		u         replicationUpdate
+		wantWords []string
+	}{
+		// Test nothing having changed, as on most heartbeats
+		{replicationUpdate{AutoAdvance: true}, nil},
+		{replicationUpdate{AutoAdvance: false, RepeatMode: RepeatAll}, []string{"AUTOADVANCE", "REPEAT"}},
+		{replicationUpdate{AutoAdvance: true, TargetEnd: end, AutoFit: true}, []string{"TARGETEND", "AUTOFIT"}},
+	}
+	for caseno, c := range cases {
+		h := &hub{pls: InitPlaylistSet(), term: 1, standby: true}
+		_, h.pl = h.pls.Active()
+		h.autoAdvance = true
+		resCh := addTestClient(h)
+
+		c.u.Term = 1
+		h.applyReplication(c.u)
+		if h.autoAdvance != c.u.AutoAdvance || h.repeatMode != c.u.RepeatMode || !h.targetEnd.Equal(c.u.TargetEnd) || h.autoFit != c.u.AutoFit {
+			t.Errorf("TestApplyModes: case %d left %v %v %v %v, want %v", caseno, h.autoAdvance, h.repeatMode, h.targetEnd, h.autoFit, c.u)
+		}
+		if words := sentWords(resCh); !reflect.DeepEqual(words, c.wantWords) {
+			t.Errorf("TestApplyModes: case %d told clients %v, want %v", caseno, words, c.wantWords)
+		}
+	}
+}
+
+func TestTakeOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		data     string
+		sel      int
+		playing  bool
+		position time.Duration
+		wantSent []string
+	}{
+		{"library:rasputin.mp3", 0, true, 5 * time.Second, []string{"load", "seek", "play"}},
+		// Test the primary not having got going with it yet
+		{"library:rasputin.mp3", 0, true, 0, []string{"load", "play"}},
+		{"library:rasputin.mp3", 0, false, 5 * time.Second, []string{"load"}},
+		// Test nothing selected, and a selection that won't load
+		{"library:rasputin.mp3", -1, true, 5 * time.Second, nil},
+		{"library:missing.mp3", 0, true, 5 * time.Second, nil},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{{Data: c.data, Hash: "aaa", Type: ItemFile}}
+		h, reqCh := newTestHub(t, dir, items, c.sel)
+		if c.data == "library:missing.mp3" {
+			os.Remove(filepath.Join(dir, "missing.mp3"))
+		}
+		h.standby, h.primaryPlaying, h.primaryPosition = true, c.playing, c.position
+		h.advertise = "studio2:1350"
+		h.downstreamState.Features = make(baps3.FeatureSet)
+		h.downstreamState.Features.AddFeature(baps3.FtSeek)
+
+		h.takeOver()
+		if h.standby || h.term != 1 || h.primary != h.advertise {
+			t.Errorf("TestTakeOver: case %d left standby %v term %d primary %q", caseno, h.standby, h.term, h.primary)
+		}
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestTakeOver: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+	}
+}
+
+func TestFollowPrimaryStop(t *testing.T) {
+	r := newReplicator()
+	addr, err := r.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updCh := make(chan replicationUpdate)
+	stop := make(chan struct{})
+	go followPrimary(addr.String(), time.Minute, updCh, nil, stop)
+	for { // Wait for the standby to be registered
+		r.Lock()
+		n := len(r.replicas)
+		r.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Nobody's reading the update, as when the hub has moved on to following another primary
+	r.Send(replicationUpdate{Primary: "studio1:1351", Term: 1})
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		for range updCh { // The update may still get through, but nothing after it
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("TestFollowPrimaryStop: still following after stopping")
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// How far ahead of a scheduled item countdowns start being broadcast.
+const countdownWindow = 5 * time.Minute
+
+func makeRsSchedule(i int, item *PlaylistItem) *baps3.Message {
+	mode := "soft"
+	if item.HardStart {
+		mode = "hard"
+	}
+	return baps3.NewMessage(RsSchedule).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(unixStr(item.StartAt)).AddArg(mode)
+}
+
+// Sets or clears when an item starts by itself.
+// Takes the index, hash, start time in Unix seconds (0 to clear) and "hard" or "soft".
+func (h *hub) processReqSchedule(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 4 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, atStr, mode := args[0], args[1], args[2], args[3]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+	secs, err := strconv.ParseInt(atStr, 10, 64)
+	if err != nil || secs < 0 {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad time"))
+	}
+	if mode != "hard" && mode != "soft" {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+	var at time.Time
+	if secs > 0 {
+		at = time.Unix(secs, 0)
+	}
+
+	curIdx, _, err := pl.SetSchedule(i, hash, at, mode == "hard")
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, makeRsSchedule(curIdx, pl.items[curIdx]))
+}
+
+// Selects, loads and plays the scheduled item at i, using up its schedule.
+func (h *hub) fireScheduled(i int) {
+	item := h.pl.items[i]
+	log.Println("Starting scheduled item", item.Data)
+	item.StartAt, item.HardStart = time.Time{}, false
+	h.persist()
+	h.broadcast(*makeRsSchedule(i, item))
+
+	oldSelected := h.pl.Selected()
+	if _, _, err := h.pl.Select(i, item.Hash); err != nil {
+		log.Println("Error selecting scheduled item:", err.Error())
+		return
+	}
+	h.leaveItem(oldSelected)
+	if h.loadSelected() {
+		h.cReqCh <- *baps3.NewMessage(baps3.RqPlay)
+	}
+	h.broadcast(*makeRsSelect(h.pl))
+}
+
+// Gives up on any scheduled items whose starts have been missed, telling clients they were.
+func (h *hub) expireMissed(now time.Time) {
+	missed := h.pl.Missed(now)
+	for _, i := range missed {
+		item := h.pl.items[i]
+		log.Println("Missed scheduled item", item.Data)
+		h.broadcast(*baps3.NewMessage(RsMissed).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(unixStr(item.StartAt)))
+		item.StartAt, item.HardStart = time.Time{}, false
+		h.broadcast(*makeRsSchedule(i, item))
+	}
+	if len(missed) > 0 {
+		h.persist()
+	}
+}
+
+// Starts any soft-start item that's due, as the downstream service has nothing else to do.
+// Returns true if one was started.
+func (h *hub) fireSoftDue(now time.Time) bool {
+	if i := h.pl.Due(now, false); i >= 0 {
+		h.fireScheduled(i)
+		return true
+	}
+	return false
+}
+
+// Does everything that happens on the clock: starting scheduled items and counting down to them,
+// timing links, watching for dead air, and keeping standbys up to date.
+func (h *hub) tick(now time.Time) {
+	if h.standby {
+		return // The primary's doing all this
+	}
+	h.replicate(false)
+
+	h.expireMissed(now)
+	if i := h.pl.Due(now, true); i >= 0 {
+		h.fireScheduled(i)
+	} else if h.autoAdvance && h.downstreamState.State != baps3.StPlaying && h.activeLink() == nil {
+		h.fireSoftDue(now) // Soft starts wait for an END otherwise, or for an operator to start things
+	}
+	h.tickLink(now)
+	h.checkSilence(now)
+
+	if i := h.pl.NextScheduled(); i >= 0 {
+		if left := h.pl.items[i].StartAt.Sub(now); left >= 0 && left <= countdownWindow {
+			h.broadcast(*baps3.NewMessage(RsCountdown).AddArg(strconv.Itoa(i)).AddArg(h.pl.items[i].Hash).AddArg(strconv.Itoa(int(left.Seconds()))))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFireScheduled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	topOfHour := time.Unix(3600, 0)
+
+	cases := []struct {
+		fileGone bool
+		wantSent []string
+	}{
+		{false, []string{"load", "play"}},
+		// Test a scheduled item whose file has gone, which is selected but can't play
+		{true, nil},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile, State: ItemPlaying},
+			{Data: "library:news.mp3", Hash: "news", Type: ItemFile, StartAt: topOfHour, HardStart: true},
+		}
+		h, reqCh := newTestHub(t, dir, items, 0)
+		if c.fileGone {
+			if err = os.Remove(filepath.Join(dir, "news.mp3")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		h.fireScheduled(1)
+		if h.pl.selection != 1 {
+			t.Errorf("TestFireScheduled: case %d selected %d, want 1", caseno, h.pl.selection)
+		}
+		if !items[1].StartAt.IsZero() || items[1].HardStart {
+			t.Errorf("TestFireScheduled: case %d left schedule %v hard %v, want it used up", caseno, items[1].StartAt, items[1].HardStart)
+		}
+		if items[0].State != ItemSkipped {
+			t.Errorf("TestFireScheduled: case %d left interrupted item %v, want %v", caseno, items[0].State, ItemSkipped)
+		}
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestFireScheduled: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+	}
+}
+
+func TestFireSoftDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	topOfHour := time.Unix(3600, 0)
+
+	cases := []struct {
+		hard     bool
+		now      time.Time
+		want     bool
+		wantSel  int
+		wantSent []string
+	}{
+		{false, topOfHour, true, 1, []string{"load", "play"}},
+		{false, topOfHour.Add(SoftStartGrace), true, 1, []string{"load", "play"}},
+		// Test a soft start that isn't due yet, or was missed
+		{false, topOfHour.Add(-time.Second), false, 0, nil},
+		{false, topOfHour.Add(SoftStartGrace + time.Second), false, 0, nil},
+		// Test a hard start, which doesn't wait for anything
+		{true, topOfHour, false, 0, nil},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile, State: ItemPlayed},
+			{Data: "library:news.mp3", Hash: "news", Type: ItemFile, StartAt: topOfHour, HardStart: c.hard},
+		}
+		h, reqCh := newTestHub(t, dir, items, 0)
+
+		if got := h.fireSoftDue(c.now); got != c.want {
+			t.Errorf("TestFireSoftDue: case %d == %v, want %v", caseno, got, c.want)
+		}
+		if h.pl.selection != c.wantSel {
+			t.Errorf("TestFireSoftDue: case %d selected %d, want %d", caseno, h.pl.selection, c.wantSel)
+		}
+		if sent := sentWords(reqCh); !reflect.DeepEqual(sent, c.wantSent) {
+			t.Errorf("TestFireSoftDue: case %d sent %v, want %v", caseno, sent, c.wantSent)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func (h *hub) makeRsTargetEnd() *baps3.Message {
+	return baps3.NewMessage(RsTargetEnd).AddArg(unixStr(h.targetEnd))
+}
+
+func (h *hub) makeRsAutoFit() *baps3.Message {
+	return baps3.NewMessage(RsAutoFit).AddArg(onOff(h.autoFit))
+}
+
+func makeRsDroppable(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsDroppable).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(onOff(item.Droppable))
+}
+
+func makeRsDropped(i int, item *PlaylistItem) *baps3.Message {
+	return baps3.NewMessage(RsDropped).AddArg(strconv.Itoa(i)).AddArg(item.Hash).AddArg(onOff(item.Dropped))
+}
+
+// Sets or clears when the playlist should end. Takes Unix seconds, or 0 to clear.
+func (h *hub) processReqEndTime(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	atStr, _ := req.Arg(0)
+	secs, err := strconv.ParseInt(atStr, 10, 64)
+	if err != nil || secs < 0 {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad time"))
+	}
+	h.targetEnd = time.Time{}
+	if secs > 0 {
+		h.targetEnd = time.Unix(secs, 0)
+	}
+	h.persist()
+	return append(resps, h.makeRsTargetEnd())
+}
+
+func (h *hub) processReqAutoFit(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	onoff, _ := req.Arg(0)
+	switch onoff {
+	case "on":
+		h.autoFit = true
+	case "off":
+		h.autoFit = false
+	default:
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+	h.persist()
+	return append(resps, h.makeRsAutoFit())
+}
+
+func (h *hub) processReqDroppable(pl *Playlist, req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) != 3 {
+		return makeBadCommandMsgs()
+	}
+	iStr, hash, onoff := args[0], args[1], args[2]
+
+	i, errResp := resolveItemArgs(pl, iStr, hash)
+	if errResp != nil {
+		return append(resps, errResp)
+	}
+	if onoff != "on" && onoff != "off" {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+
+	curIdx, _, err := pl.SetDroppable(i, hash, onoff == "on")
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	h.persist()
+	return append(resps, makeRsDroppable(curIdx, pl.items[curIdx]))
+}
+
+// How far the projected end is past the target end; negative if it's short.
+func (h *hub) overrun(p projection) time.Duration {
+	return p.end.Sub(h.targetEnd)
+}
+
+// Drops droppable items from an overrunning playlist, and pulls fillers into an underrunning one,
+// until the projected end is within the drift threshold of the target or there's nothing else to do.
+// Dropped items stay in the playlist, just out of the running order, and which they are is worked out
+// afresh each time, so they come back if the show stops overrunning.
+func (h *hub) fitToEnd() {
+	if h.standby {
+		return // The primary's doing this
+	}
+	fitting := h.autoFit && !h.targetEnd.IsZero()
+
+	wasDropped := make(map[*PlaylistItem]bool)
+	for _, item := range h.pl.items {
+		if item.Dropped {
+			wasDropped[item], item.Dropped = true, false
+		}
+	}
+	if fitting {
+		for i := h.pl.LastDroppable(len(h.pl.items)); i >= 0; i = h.pl.LastDroppable(i) {
+			if h.overrun(h.project()) <= h.driftThreshold {
+				break
+			}
+			h.pl.items[i].Dropped = true
+		}
+	}
+	for i, item := range h.pl.items {
+		if item.Dropped != wasDropped[item] {
+			if item.Dropped {
+				log.Println("Dropped", item.Data, "to bring in overrun")
+			}
+			h.broadcast(*makeRsDropped(i, item))
+		}
+	}
+
+	added := false
+	for fitting && h.fillerDir != "" {
+		gap := -h.overrun(h.project())
+		if gap <= h.driftThreshold {
+			break
+		}
+		e := h.pickFiller(gap)
+		if e == nil {
+			break
+		}
+		// Fillers can go again if they turn out not to be needed
+		item := &PlaylistItem{Data: e.Data, Hash: PlaceholderHash, Type: ItemFile, Droppable: true}
+		for k, v := range e.Meta {
+			item.SetMeta(k, v)
+		}
+		i, err := h.pl.Enqueue(-1, item)
+		if err != nil {
+			log.Println("Error adding filler:", err.Error())
+			break
+		}
+		log.Println("Added filler", item.Data, "to fill underrun")
+		h.analyse(item.Hash, item.Data)
+		h.broadcast(*addItemArgs(baps3.NewMessage(baps3.RsEnqueue), i, item))
+		for _, msg := range makeItemDetailResponses(i, item) {
+			h.broadcast(*msg)
+		}
+		added = true
+	}
+	if added {
+		h.persist()
+	}
+}
+
+// Picks the longest usable filler from the pool that fits in gap and isn't already in the playlist.
+// Returns nil if nothing fits.
+func (h *hub) pickFiller(gap time.Duration) *libraryEntry {
+	inPlaylist := make(map[string]bool)
+	for _, data := range h.pl.FileData() {
+		inPlaylist[data] = true
+	}
+	_, files, err := h.lib.Browse(h.fillerDir)
+	if err != nil {
+		log.Println("Error finding fillers:", err.Error())
+		return nil
+	}
+	var fits []*libraryEntry
+	for _, e := range files {
+		if d := metaDuration(e.Meta); d > 0 && d <= gap && !inPlaylist[e.Data] {
+			fits = append(fits, e)
+		}
+	}
+	sort.Stable(byDurationDesc(fits))
+	// The library can be behind the disk, so check before trusting it
+	for _, e := range fits {
+		if reason := h.validator.Validate(e.Data); reason != "" {
+			log.Println("Not using filler", e.Data, ":", reason)
+			continue
+		}
+		return e
+	}
+	return nil
+}
+
+type byDurationDesc []*libraryEntry
+
+func (b byDurationDesc) Len() int      { return len(b) }
+func (b byDurationDesc) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byDurationDesc) Less(i, j int) bool {
+	return metaDuration(b[i].Meta) > metaDuration(b[j].Meta)
+}
+
+// Warns clients when the projected end drifts more than the threshold from the target,
+// and tells them when it comes back. Drift is in seconds, positive for an overrun.
+func (h *hub) checkDrift(p projection) {
+	if h.targetEnd.IsZero() {
+		h.driftWarned = false
+		return
+	}
+	over := h.overrun(p)
+	drift := int64(over / time.Second)
+	beyond := over > h.driftThreshold || -over > h.driftThreshold
+	if (beyond && (drift != h.lastDrift || !h.driftWarned)) || (!beyond && h.driftWarned) {
+		h.broadcast(*baps3.NewMessage(RsDrift).AddArg(strconv.FormatInt(drift, 10)))
+	}
+	h.driftWarned, h.lastDrift = beyond, drift
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Gives item metadata saying it lasts mins minutes.
+func lasting(mins float64) map[string]string {
+	return map[string]string{"duration": strconv.FormatInt(int64(mins*60*1000000), 10)}
+}
+
+// Adds fillers to the library of h, as if scanned from the fillers directory of the "library" media root, dir.
+// Those in gone are left off the disk.
+func addTestFillers(t *testing.T, h *hub, dir string, fillers map[string]float64, gone ...string) {
+	h.lib = newLibrary("", h.validator)
+	h.fillerDir = "library:fillers"
+	if err := os.MkdirAll(filepath.Join(dir, "fillers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, mins := range fillers {
+		data := "library:fillers/" + name
+		h.lib.entries[data] = &libraryEntry{Data: data, Meta: lasting(mins)}
+		if containsString(gone, name) {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "fillers", name), []byte("ra ra"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFitToEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		targetIn    time.Duration // From now, or 0 for no target
+		autoFit     bool
+		fillers     bool
+		wasDropped  []string
+		wantDropped []string
+		wantAdded   []string
+	}{
+		// Test dropping the last droppable items first, only as far as needed
+		{17 * time.Minute, true, false, nil, []string{"ccc"}, nil},
+		{12 * time.Minute, true, false, nil, []string{"bbb", "ccc"}, nil},
+		{10 * time.Minute, true, false, nil, []string{"bbb", "ccc"}, nil},
+		// Test restoring dropped items once they fit again, or fitting's off
+		{20 * time.Minute, true, false, []string{"bbb", "ccc"}, nil, nil},
+		{17 * time.Minute, false, false, []string{"ccc"}, nil, nil},
+		{0, true, false, []string{"ccc"}, nil, nil},
+		// Test filling an underrun, longest filler first, leaving out those already in
+		{24 * time.Minute, true, true, nil, nil, []string{"library:fillers/three.mp3"}},
+		{25*time.Minute + 15*time.Second, true, true, nil, nil, []string{"library:fillers/five.mp3"}},
+		// Test an overrun, which fillers don't help
+		{17 * time.Minute, true, true, nil, []string{"ccc"}, nil},
+	}
+	for caseno, c := range cases {
+		items := []*PlaylistItem{
+			{Data: "library:rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: lasting(10)},
+			{Data: "library:mabaker.mp3", Hash: "bbb", Type: ItemFile, Meta: lasting(5), Droppable: true},
+			{Data: "library:sunny.mp3", Hash: "ccc", Type: ItemFile, Meta: lasting(3), Droppable: true},
+			{Data: "library:fillers/half.mp3", Hash: "ddd", Type: ItemFile, Meta: lasting(2)},
+		}
+		h, _ := newTestHub(t, dir, items, -1)
+		addTestFillers(t, h, dir, map[string]float64{"ten.mp3": 10, "five.mp3": 5, "three.mp3": 3, "half.mp3": 0.5})
+		h.downstreamState.State = baps3.StEjected
+		h.driftThreshold = 20 * time.Second
+		h.autoFit = c.autoFit
+		if !c.fillers {
+			h.fillerDir = ""
+		}
+		if c.targetIn != 0 {
+			h.targetEnd = time.Now().Add(c.targetIn)
+		}
+		for _, item := range items {
+			item.Dropped = containsString(c.wasDropped, item.Hash)
+		}
+
+		h.fitToEnd()
+		var dropped, added []string
+		for i, item := range h.pl.items {
+			if item.Dropped {
+				dropped = append(dropped, item.Hash)
+			}
+			if i >= len(items) {
+				added = append(added, item.Data)
+			}
+		}
+		if !reflect.DeepEqual(dropped, c.wantDropped) {
+			t.Errorf("TestFitToEnd: case %d dropped %v, want %v", caseno, dropped, c.wantDropped)
+		}
+		if !reflect.DeepEqual(added, c.wantAdded) {
+			t.Errorf("TestFitToEnd: case %d added %v, want %v", caseno, added, c.wantAdded)
+		}
+	}
+}
+
+func TestPickFiller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, _ := newTestHub(t, dir, nil, -1)
+	addTestFillers(t, h, dir, map[string]float64{"ten.mp3": 10, "three.mp3": 3, "two.mp3": 2, "one.mp3": 1, "half.mp3": 0.5}, "two.mp3")
+	h.lib.entries["library:fillers/unknown.mp3"] = &libraryEntry{Data: "library:fillers/unknown.mp3"}
+	h.pl.Enqueue(0, &PlaylistItem{Data: "library:fillers/half.mp3", Hash: "aaa", Type: ItemFile})
+
+	cases := []struct {
+		fillerDir string
+		gap       time.Duration
+		want      string
+	}{
+		{"library:fillers", 20 * time.Minute, "library:fillers/ten.mp3"},
+		{"library:fillers", 10 * time.Minute, "library:fillers/ten.mp3"},
+		{"library:fillers", 5 * time.Minute, "library:fillers/three.mp3"},
+		// Test skipping fillers whose files have gone, or that are already in the playlist
+		{"library:fillers", 150 * time.Second, "library:fillers/one.mp3"},
+		{"library:fillers", 50 * time.Second, ""},
+		// Test a filler directory that isn't one
+		{"fillers", 20 * time.Minute, ""},
+	}
+	for _, c := range cases {
+		h.fillerDir = c.fillerDir
+		got := ""
+		if e := h.pickFiller(c.gap); e != nil {
+			got = e.Data
+		}
+		if got != c.want {
+			t.Errorf("TestPickFiller: pickFiller(%v) from %q == %q, want %q", c.gap, c.fillerDir, got, c.want)
+		}
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	target := time.Unix(1420113600, 0)
+	h := &hub{targetEnd: target, driftThreshold: time.Minute}
+	resCh := addTestClient(h)
+
+	steps := []struct {
+		end       time.Time
+		clear     bool
+		wantDrift string // "" for no DRIFT
+	}{
+		{target.Add(30 * time.Second), false, ""},
+		{target.Add(90 * time.Second), false, "90"},
+		// Test only warning again once the drift changes
+		{target.Add(90*time.Second + 500*time.Millisecond), false, ""},
+		{target.Add(2 * time.Minute), false, "120"},
+		// Test saying once when it's back
+		{target.Add(10 * time.Second), false, "10"},
+		{target.Add(5 * time.Second), false, ""},
+		{target.Add(-90 * time.Second), false, "-90"},
+		// Test clearing the target, then coming back to the same drift as before
+		{target.Add(-90 * time.Second), true, ""},
+		{target.Add(-90 * time.Second), false, "-90"},
+	}
+	for stepno, s := range steps {
+		if s.clear {
+			h.targetEnd = time.Time{}
+		} else {
+			h.targetEnd = target
+		}
+		h.checkDrift(projection{end: s.end})
+
+		got := ""
+		select {
+		case res := <-resCh:
+			got = res.Args()[0]
+		default:
+		}
+		if got != s.wantDrift {
+			t.Errorf("TestCheckDrift: step %d sent drift %q, want %q", stepno, got, s.wantDrift)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The parts of ffprobe's JSON output we use.
+type ffprobeOutput struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		Tags map[string]string `json:"tags"`
+	} `json:"streams"`
+}
+
+// Tags copied into item metadata. ID3 and Vorbis comments disagree on case, so keys are lowercased first.
+var wantedTags = []string{"title", "artist", "album"}
+
+// Reads tags and duration from the file at path, belonging to the item with the given hash and data,
+// sending the result down resCh.
+// Meant to be run in its own goroutine, as ffprobe can take a while on slow disks.
+func readTags(ffprobe string, hash string, data string, path string, resCh chan<- fileResult) {
+	res := fileResult{hash: hash, data: data, stamp: stampFile(path)}
+	res.meta, res.fileError = probeFile(ffprobe, path)
+	resCh <- res
+}
+
+// Reads tags and duration from the file at path using ffprobe.
+// Returns the metadata found, and why the file can't be used if it can't.
+func probeFile(ffprobe string, path string) (meta map[string]string, fileError string) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, FileMissing
+		}
+		return nil, FileUnreadable
+	}
+
+	out, err := exec.Command(ffprobe, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", path).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, FileUnreadable
+		}
+		// Couldn't run ffprobe at all, which isn't the file's fault
+		log.Println("Error running ffprobe:", err.Error())
+		return nil, ""
+	}
+	var probe ffprobeOutput
+	if err = json.Unmarshal(out, &probe); err != nil {
+		log.Println("Error parsing ffprobe output:", err.Error())
+		return nil, ""
+	}
+
+	meta = make(map[string]string)
+	// Ogg files keep their tags on the audio stream rather than the container, so stream tags fill in any gaps
+	tagSets := []map[string]string{probe.Format.Tags}
+	for _, stream := range probe.Streams {
+		tagSets = append(tagSets, stream.Tags)
+	}
+	for _, tags := range tagSets {
+		for k, v := range tags {
+			k = strings.ToLower(k)
+			if _, ok := meta[k]; ok {
+				continue
+			}
+			for _, want := range wantedTags {
+				if k == want {
+					meta[k] = v
+				}
+			}
+		}
+	}
+	// Durations are in microseconds, like TIME
+	if secs, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		meta["duration"] = strconv.FormatInt(int64(secs*1000000), 10)
+	}
+	return meta, ""
+}
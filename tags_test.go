@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReadTagsMissing(t *testing.T) {
+	resCh := make(chan fileResult, 1)
+	readTags("ffprobe", "aaa", "library:rasputin.mp3", "/nonexistent/rasputin.mp3", resCh)
+	res := <-resCh
+	if res.hash != "aaa" || res.data != "library:rasputin.mp3" {
+		t.Errorf("TestReadTagsMissing: result for wrong item (%s, %s)", res.hash, res.data)
+	}
+	if res.fileError != FileMissing {
+		t.Errorf("TestReadTagsMissing: fileError == %q, want %q", res.fileError, FileMissing)
+	}
+	if res.meta != nil {
+		t.Errorf("TestReadTagsMissing: meta == %v, want nil", res.meta)
+	}
+}
+
+func TestProbeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rasputin.mp3")
+	if err = ioutil.WriteFile(file, []byte("ra ra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		output        string
+		status        int
+		wantMeta      map[string]string
+		wantFileError string
+	}{
+		// Test ID3 tags, on the container
+		{
+			`{"streams": [{"index": 0}], "format": {"duration": "330.500000", "tags": {"title": "Rasputin", "artist": "Boney M.", "genre": "Disco"}}}`, 0,
+			map[string]string{"title": "Rasputin", "artist": "Boney M.", "duration": "330500000"}, "",
+		},
+		// Test Vorbis comments, on the stream, filling in what the container hasn't got
+		{
+			`{"streams": [{"index": 0, "tags": {"TITLE": "Ma Baker", "ARTIST": "Boney M.", "ALBUM": "Love for Sale"}}], "format": {"duration": "276.25", "tags": {"title": "Ma Baker (Edit)"}}}`, 0,
+			map[string]string{"title": "Ma Baker (Edit)", "artist": "Boney M.", "album": "Love for Sale", "duration": "276250000"}, "",
+		},
+		// Test a file without a known duration
+		{`{"format": {"duration": "N/A"}}`, 0, map[string]string{}, ""},
+		// Test a file ffprobe can't read
+		{"", 1, nil, FileUnreadable},
+		// Test output that isn't JSON, which isn't the file's fault
+		{"rasputin.mp3: Invalid data", 0, nil, ""},
+	}
+	for caseno, c := range cases {
+		// A stand-in for ffprobe that prints the case's output
+		ffprobe := filepath.Join(dir, "ffprobe")
+		script := "#!/bin/sh\ncat <<'EOF'\n" + c.output + "\nEOF\nexit " + strconv.Itoa(c.status) + "\n"
+		if err = ioutil.WriteFile(ffprobe, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		meta, fileError := probeFile(ffprobe, file)
+		if !reflect.DeepEqual(meta, c.wantMeta) || fileError != c.wantFileError {
+			t.Errorf("TestProbeFile: case %d == %v, %q, want %v, %q", caseno, meta, fileError, c.wantMeta, c.wantFileError)
+		}
+	}
+}
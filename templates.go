@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Keeps playlist templates for recurring shows, one file per template, in the same form as a saved playlist.
+type templateStore struct {
+	dir string
+}
+
+// The file holding the template called name, or an error if name can't be a template name.
+func (s *templateStore) fileFor(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("Bad template name")
+	}
+	return filepath.Join(s.dir, name+".json"), nil
+}
+
+// Names gives the names of all the templates, in order.
+func (s *templateStore) Names() (names []string, err error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		names = append(names, strings.TrimSuffix(filepath.Base(p), ".json"))
+	}
+	sort.Strings(names)
+	return
+}
+
+// Save makes pl into the template called name, replacing any already there.
+func (s *templateStore) Save(name string, pl *Playlist) error {
+	path, err := s.fileFor(name)
+	if err != nil {
+		return err
+	}
+	return pl.Copy().Save(path)
+}
+
+// Load gives the items of the template called name.
+func (s *templateStore) Load(name string) ([]*PlaylistItem, error) {
+	path, err := s.fileFor(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No such template")
+	} else if err != nil {
+		return nil, err
+	}
+	pl, err := decodePlaylist(data)
+	if err != nil {
+		return nil, err
+	}
+	return pl.items, nil
+}
+
+// Delete removes the template called name.
+func (s *templateStore) Delete(name string) error {
+	path, err := s.fileFor(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); os.IsNotExist(err) {
+		return fmt.Errorf("No such template")
+	}
+	return err
+}
+
+// Fills in a template's items for the show on date.
+// Placeholders in data and metadata are expanded, scheduled items are moved to the same time of day on date,
+// and every item is given a placeholder hash, so it gets a fresh one when enqueued.
+func instantiateTemplate(items []*PlaylistItem, date time.Time) []*PlaylistItem {
+	r := strings.NewReplacer(
+		"{date}", date.Format(dateLayout),
+		"{year}", date.Format("2006"),
+		"{month}", date.Format("01"),
+		"{day}", date.Format("02"),
+		"{weekday}", date.Format("Monday"),
+	)
+	y, m, d := date.Date()
+
+	made := makePlaylist(items, -1).Copy().items
+	for _, item := range made {
+		item.Hash = PlaceholderHash
+		item.FileError = ""
+		item.Data = r.Replace(item.Data)
+		for k, v := range item.Meta {
+			item.Meta[k] = r.Replace(v)
+		}
+		if !item.StartAt.IsZero() {
+			at := item.StartAt.In(date.Location())
+			item.StartAt = time.Date(y, m, d, at.Hour(), at.Minute(), at.Second(), 0, date.Location())
+		}
+	}
+	return made
+}
+
+func makeRsTemplate(name string) *baps3.Message {
+	return baps3.NewMessage(RsTemplate).AddArg(name)
+}
+
+func (h *hub) processReqTemplates(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 0 {
+		return makeBadCommandMsgs()
+	}
+	if h.templates == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No templates"))
+	}
+	names, err := h.templates.Names()
+	if err != nil {
+		log.Println("Error listing templates:", err.Error())
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("Can't list templates"))
+	}
+	resps = append(resps, baps3.NewMessage(RsResults).AddArg(strconv.Itoa(len(names))))
+	for _, name := range names {
+		resps = append(resps, makeRsTemplate(name))
+	}
+	return
+}
+
+// Saves the active playlist as a template.
+func (h *hub) processReqSaveTemplate(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	if h.templates == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No templates"))
+	}
+	name, _ := req.Arg(0)
+	if err := h.templates.Save(name, h.pl); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	return append(resps, makeRsTemplate(name))
+}
+
+func (h *hub) processReqDeleteTemplate(req baps3.Message) (resps []*baps3.Message) {
+	if len(req.Args()) != 1 {
+		return makeBadCommandMsgs()
+	}
+	if h.templates == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No templates"))
+	}
+	name, _ := req.Arg(0)
+	if err := h.templates.Delete(name); err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+	return append(resps, baps3.NewMessage(RsDeleteTemplate).AddArg(name))
+}
+
+// Appends a template's items to the active playlist.
+// Takes the template name and, optionally, the date of the show to fill its placeholders in for (today if omitted).
+// File items whose files can't be used are still added, so the show can see what's missing.
+func (h *hub) processReqInstantiate(req baps3.Message) (resps []*baps3.Message) {
+	args := req.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return makeBadCommandMsgs()
+	}
+	if h.templates == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No templates"))
+	}
+	date := time.Now()
+	if len(args) == 2 {
+		var err error
+		if date, err = time.ParseInLocation(dateLayout, args[1], time.Local); err != nil {
+			return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad date"))
+		}
+	}
+	items, err := h.templates.Load(args[0])
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
+	}
+
+	for _, item := range instantiateTemplate(items, date) {
+		i, err := h.pl.Enqueue(-1, item)
+		if err != nil {
+			log.Println("Error adding template item:", err.Error())
+			continue
+		}
+		resps = append(resps, addItemArgs(baps3.NewMessage(baps3.RsEnqueue), i, item))
+		if item.IsFile() {
+			if reason := h.validator.Validate(item.Data); reason != "" {
+				item.FileError = reason
+			} else {
+				path, _ := h.validator.Resolve(item.Data)
+				go readTags(h.ffprobe, item.Hash, item.Data, path, h.fileCh)
+				h.analyse(item.Hash, item.Data)
+			}
+		}
+		resps = append(resps, makeItemDetailResponses(i, item)...)
+	}
+	h.persist()
+	return
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &templateStore{dir: dir}
+
+	pl := makePlaylist(
+		[]*PlaylistItem{
+			&PlaylistItem{Data: "jingles:intro.mp3", Hash: "aaa", Type: ItemFile, State: ItemPlayed},
+			&PlaylistItem{Data: "Welcome", Hash: "link", Type: ItemLink},
+		},
+		0,
+	)
+	if err = s.Save("breakfast", pl); err != nil {
+		t.Fatalf("TestTemplateStore: save returned err (%s)", err.Error())
+	}
+	if err = s.Save("../breakfast", pl); err == nil {
+		t.Errorf("TestTemplateStore: save with bad name returned nil when should be err")
+	}
+	if names, err := s.Names(); err != nil || !reflect.DeepEqual(names, []string{"breakfast"}) {
+		t.Errorf("TestTemplateStore: names == %q, %v, want [breakfast]", names, err)
+	}
+
+	items, err := s.Load("breakfast")
+	if err != nil {
+		t.Fatalf("TestTemplateStore: load returned err (%s)", err.Error())
+	}
+	if want := pl.Copy().items; !reflect.DeepEqual(items, want) {
+		t.Errorf("TestTemplateStore: loaded %v, want %v", items, want)
+	}
+
+	if err = s.Delete("breakfast"); err != nil {
+		t.Errorf("TestTemplateStore: delete returned err (%s)", err.Error())
+	}
+	if _, err = s.Load("breakfast"); err == nil {
+		t.Errorf("TestTemplateStore: load of deleted template returned nil when should be err")
+	}
+	if err = s.Delete("breakfast"); err == nil {
+		t.Errorf("TestTemplateStore: delete of deleted template returned nil when should be err")
+	}
+}
+
+func TestInstantiateTemplate(t *testing.T) {
+	template := []*PlaylistItem{
+		&PlaylistItem{Data: "news:{date}.mp3", Hash: "news", Type: ItemFile, FileError: FileMissing, StartAt: time.Date(2015, 3, 2, 8, 0, 0, 0, time.Local), HardStart: true},
+		&PlaylistItem{Data: "It's {weekday}!", Hash: "link", Type: ItemLink, Meta: map[string]string{"title": "{day}/{month}/{year}"}},
+	}
+	date := time.Date(2015, 3, 13, 0, 0, 0, 0, time.Local)
+
+	got := instantiateTemplate(template, date)
+	want := []*PlaylistItem{
+		&PlaylistItem{Data: "news:2015-03-13.mp3", Hash: PlaceholderHash, Type: ItemFile, StartAt: time.Date(2015, 3, 13, 8, 0, 0, 0, time.Local), HardStart: true},
+		&PlaylistItem{Data: "It's Friday!", Hash: PlaceholderHash, Type: ItemLink, Meta: map[string]string{"title": "13/03/2015"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TestInstantiateTemplate: got %v, want %v", got, want)
+	}
+	if template[0].Data != "news:{date}.mp3" || template[1].Meta["title"] != "{day}/{month}/{year}" {
+		t.Errorf("TestInstantiateTemplate: template was changed")
+	}
+}
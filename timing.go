@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Duration gives how long the item lasts, from its duration metadata, or 0 if that isn't known.
+func (item *PlaylistItem) Duration() time.Duration {
+	return metaDuration(item.Meta)
+}
+
+// End gives where playback of the item stops: its cue out if set, otherwise its duration.
+func (item *PlaylistItem) End() time.Duration {
+	if item.CueOut > 0 {
+		return item.CueOut
+	}
+	return item.Duration()
+}
+
+// PlayLength gives how long the item takes to play from cue in to end, or 0 if that isn't known.
+func (item *PlaylistItem) PlayLength() time.Duration {
+	if l := item.End() - item.CueIn; l > 0 {
+		return l
+	}
+	return 0
+}
+
+// Reads the duration, in microseconds like TIME, out of metadata.
+func metaDuration(meta map[string]string) time.Duration {
+	us, err := strconv.ParseInt(meta["duration"], 10, 64)
+	if err != nil || us < 0 {
+		return 0
+	}
+	return time.Duration(us) * time.Microsecond
+}
+
+// When things in the running order are expected to happen.
+type projection struct {
+	starts map[string]time.Time // Start times of the items after the selection, by hash
+	end    time.Time            // When the last item finishes
+}
+
+// Project works out when each item after the selection will start, and when the playlist will end,
+// if the selected item is position into playing at now and everything after runs back to back.
+// Without a selection, the whole playlist is projected from now.
+// Items play from cue in to cue out, those of unknown duration count as taking no time,
+// dropped items are left out, and hard-start items start when scheduled.
+func (pl *Playlist) Project(now time.Time, position time.Duration) projection {
+	p := projection{starts: make(map[string]time.Time), end: now}
+	first := 0
+	if sel := pl.Selected(); sel != nil {
+		if left := sel.End() - position; left > 0 {
+			p.end = now.Add(left)
+		}
+		first = pl.selection + 1
+	}
+	for _, item := range pl.items[first:] {
+		if item.Dropped {
+			continue // Won't be played, so has no start
+		}
+		if item.HardStart && !item.StartAt.IsZero() {
+			p.end = item.StartAt
+		}
+		p.starts[item.Hash] = p.end
+		p.end = p.end.Add(item.PlayLength())
+	}
+	return p
+}
+
+// How far the running order's timings can wander before clients are sent new ones.
+// While something's playing, they only wander as playd's reports of its position jitter, or on a seek.
+// While nothing is, they slide along with the clock, so are only caught up now and then.
+const (
+	timingSlack    = 2 * time.Second
+	idleTimingStep = 30 * time.Second
+)
+
+// What the running order's timings were last worked out from, other than the clock.
+type timingBasis struct {
+	pl         *Playlist
+	revision   int
+	selection  int
+	state      baps3.State
+	linkActive bool
+	targetEnd  int64
+	autoFit    bool
+}
+
+func (h *hub) timingBasis() timingBasis {
+	return timingBasis{
+		pl:         h.pl,
+		revision:   h.revision,
+		selection:  h.pl.selection,
+		state:      h.downstreamState.State,
+		linkActive: h.activeLink() != nil,
+		targetEnd:  h.targetEnd.Unix(),
+		autoFit:    h.autoFit,
+	}
+}
+
+// Works out what the running order's timings are measured from at now: how far into the selected item
+// things are, and when it started, or would have had it been playing all along.
+// running is whether that's moving along with the clock.
+func (h *hub) timingOrigin(now time.Time) (origin time.Time, position time.Duration, running bool) {
+	if link := h.activeLink(); link != nil {
+		position, running = now.Sub(link.Started), true
+	} else if h.downstreamState.State != baps3.StEjected {
+		position, running = h.downstreamState.Time, h.downstreamState.State == baps3.StPlaying
+	}
+	return now.Add(-position), position, running
+}
+
+// Whether the timings last worked out still hold, near enough, for origin.
+func (h *hub) timingsCurrent(origin time.Time, running bool) bool {
+	if h.timingBasis() != h.lastBasis {
+		return false
+	}
+	moved := origin.Sub(h.lastOrigin)
+	if running {
+		return moved >= -timingSlack && moved <= timingSlack
+	}
+	return moved >= 0 && moved < idleTimingStep
+}
+
+// Works out the running order's timings as things stand, as last sent to clients if they still hold.
+func (h *hub) project() projection {
+	origin, position, running := h.timingOrigin(time.Now())
+	if h.timingsCurrent(origin, running) {
+		origin = h.lastOrigin
+	}
+	return h.pl.Project(origin.Add(position), position)
+}
+
+func makeRsBacktime(i int, hash string, start time.Time) *baps3.Message {
+	return baps3.NewMessage(RsBacktime).AddArg(strconv.Itoa(i)).AddArg(hash).AddArg(unixStr(start))
+}
+
+func makeRsEndTime(end time.Time) *baps3.Message {
+	return baps3.NewMessage(RsEndTime).AddArg(unixStr(end))
+}
+
+// Collates the responses giving the projected start of each item after the selection,
+// and the projected end of the playlist.
+func (h *hub) makeTimingResponses() (msgs []*baps3.Message) {
+	p := h.project()
+	for i, item := range h.pl.items {
+		if start, ok := p.starts[item.Hash]; ok {
+			msgs = append(msgs, makeRsBacktime(i, item.Hash, start))
+		}
+	}
+	return append(msgs, makeRsEndTime(p.end))
+}
+
+// Re-projects the running order, telling clients about any times that have moved.
+// Nothing is worked out again unless the playlist or what's playing has changed, or the timings have
+// wandered, so this can be run after anything that might change them.
+func (h *hub) updateTimings() {
+	origin, position, running := h.timingOrigin(time.Now())
+	if h.timingsCurrent(origin, running) {
+		return
+	}
+	h.fitToEnd()
+	h.lastBasis, h.lastOrigin = h.timingBasis(), origin
+
+	p := h.pl.Project(origin.Add(position), position)
+	starts := make(map[string]int64, len(p.starts))
+	for i, item := range h.pl.items {
+		start, ok := p.starts[item.Hash]
+		if !ok {
+			continue
+		}
+		starts[item.Hash] = start.Unix()
+		if last, ok := h.lastStarts[item.Hash]; !ok || last != start.Unix() {
+			h.broadcast(*makeRsBacktime(i, item.Hash, start))
+		}
+	}
+	h.lastStarts = starts
+	if p.end.Unix() != h.lastEnd {
+		h.lastEnd = p.end.Unix()
+		h.broadcast(*makeRsEndTime(p.end))
+	}
+	h.checkDrift(p)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestProject(t *testing.T) {
+	now := time.Unix(1000, 0)
+	dur := func(secs string) map[string]string {
+		return map[string]string{"duration": secs + "000000"}
+	}
+	items := []*PlaylistItem{
+		&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: dur("200")},
+		&PlaylistItem{Data: "Link: weather", Hash: "link", Type: ItemText},
+		&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile, Meta: dur("100")},
+		&PlaylistItem{Data: "mystery.mp3", Hash: "ccc", Type: ItemFile},
+		&PlaylistItem{Data: "science.mp3", Hash: "ddd", Type: ItemFile, Meta: dur("60")},
+	}
+
+	cases := []struct {
+		selection int
+		position  time.Duration
+		want      projection
+	}{
+		// Test from a selection part way through
+		{
+			0,
+			50 * time.Second,
+			projection{
+				map[string]time.Time{
+					"link": time.Unix(1150, 0),
+					"bbb":  time.Unix(1150, 0),
+					"ccc":  time.Unix(1250, 0),
+					"ddd":  time.Unix(1250, 0),
+				},
+				time.Unix(1310, 0),
+			},
+		},
+		// Test without a selection
+		{
+			-1,
+			0,
+			projection{
+				map[string]time.Time{
+					"aaa":  time.Unix(1000, 0),
+					"link": time.Unix(1200, 0),
+					"bbb":  time.Unix(1200, 0),
+					"ccc":  time.Unix(1300, 0),
+					"ddd":  time.Unix(1300, 0),
+				},
+				time.Unix(1360, 0),
+			},
+		},
+		// Test last item overrunning its duration
+		{
+			4,
+			90 * time.Second,
+			projection{
+				map[string]time.Time{},
+				time.Unix(1000, 0),
+			},
+		},
+	}
+
+	for caseno, c := range cases {
+		pl := makePlaylist(items, c.selection)
+		if got := pl.Project(now, c.position); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("TestProject: case %d gave %v, want %v", caseno, got, c.want)
+		}
+	}
+
+	// Test hard starts pin the running order
+	pl := makePlaylist(items, 0)
+	pl.items[3].StartAt, pl.items[3].HardStart = time.Unix(2000, 0), true
+	got := pl.Project(now, 0)
+	if got.starts["ccc"] != time.Unix(2000, 0) || got.end != time.Unix(2060, 0) {
+		t.Errorf("TestProject: hard start gave %v", got)
+	}
+
+	// Test cued items only count from cue in to cue out
+	cued := makePlaylist([]*PlaylistItem{
+		&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: dur("200"), CueIn: 5 * time.Second, CueOut: 185 * time.Second},
+		&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile, Meta: dur("100"), CueIn: 10 * time.Second},
+	}, 0)
+	got = cued.Project(now, 65*time.Second)
+	if got.starts["bbb"] != time.Unix(1120, 0) || got.end != time.Unix(1210, 0) {
+		t.Errorf("TestProject: cued items gave %v", got)
+	}
+
+	// Test dropped items are left out of the running order
+	dropped := makePlaylist([]*PlaylistItem{
+		&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile, Meta: dur("200")},
+		&PlaylistItem{Data: "mabaker.mp3", Hash: "bbb", Type: ItemFile, Meta: dur("100"), Dropped: true},
+		&PlaylistItem{Data: "science.mp3", Hash: "ddd", Type: ItemFile, Meta: dur("60")},
+	}, 0)
+	got = dropped.Project(now, 0)
+	if _, ok := got.starts["bbb"]; ok || got.starts["ddd"] != time.Unix(1200, 0) || got.end != time.Unix(1260, 0) {
+		t.Errorf("TestProject: dropped item gave %v", got)
+	}
+	if idx := dropped.Next(); idx != 2 {
+		t.Errorf("TestProject: Next() past dropped item == %d, want 2", idx)
+	}
+}
+
+func TestTimingsCurrent(t *testing.T) {
+	h := &hub{pl: makePlaylist([]*PlaylistItem{&PlaylistItem{Data: "rasputin.mp3", Hash: "aaa", Type: ItemFile}}, 0)}
+	h.downstreamState.State = baps3.StPlaying
+	origin := time.Unix(1000, 0)
+	h.lastBasis, h.lastOrigin = h.timingBasis(), origin
+
+	cases := []struct {
+		moved   time.Duration
+		running bool
+		want    bool
+	}{
+		// Test playing, where only jumps count
+		{0, true, true},
+		{time.Second, true, true},
+		{-time.Second, true, true},
+		{timingSlack + time.Second, true, false},
+		{-timingSlack - time.Second, true, false},
+		// Test idle, where the projection slides along with the clock
+		{10 * time.Second, false, true},
+		{idleTimingStep, false, false},
+		{-time.Second, false, false},
+	}
+	for caseno, c := range cases {
+		if got := h.timingsCurrent(origin.Add(c.moved), c.running); got != c.want {
+			t.Errorf("TestTimingsCurrent: case %d == %v, want %v", caseno, got, c.want)
+		}
+	}
+
+	// Test changes to the playlist
+	h.revision++
+	if h.timingsCurrent(origin, true) {
+		t.Errorf("TestTimingsCurrent: after a change == true, want false")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Reasons a file item's file can't be used.
+const (
+	FileMissing      = "missing"
+	FileUnreadable   = "unreadable"
+	FileBadType      = "not an allowed type"
+	FileOutsideRoots = "outside the media roots"
+)
+
+// The outcome of looking at a file item's file off the hub loop, sent back to the hub to apply.
+// The item's data is included so the result can be discarded if the hash has since been reused.
+type fileResult struct {
+	hash      string
+	data      string
+	meta      map[string]string // Tags read from the file, if any
+	fileError string
+	stamp     fileStamp // The file as it was looked at
+	recheck   bool      // From a recheck, which only validates, so can't say whether ffprobe can read the file
+}
+
+// The state of a file when it was looked at, to tell whether it has changed since.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Stamps the file at path, giving the zero stamp if it can't be looked at.
+func stampFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// Whether s and o are of the same, unchanged, file.
+func (s fileStamp) same(o fileStamp) bool {
+	return s.modTime.Equal(o.modTime) && s.size == o.size
+}
+
+// A directory of media that file items can refer to as name:relative/path.
+type mediaRoot struct {
+	name string
+	dir  string // Absolute, with symlinks resolved, so paths can be compared against it
+}
+
+// Checks file items' files are usable before they go anywhere near the downstream service.
+type fileValidator struct {
+	// Allowed extensions, lowercase without the dot. Anything goes if empty.
+	extensions []string
+	// Directories files must be inside.
+	// If empty, any file listd can read goes, as it did before there were roots; main warns about that.
+	roots []mediaRoot
+}
+
+// newFileValidator makes a fileValidator from configuration.
+// Each root is of the form [name=]dir, the name defaulting to the directory's base name.
+// exts is comma-separated, and may be empty to allow any extension.
+func newFileValidator(roots []string, exts string) (*fileValidator, error) {
+	v := &fileValidator{}
+	for _, root := range roots {
+		name, dir := filepath.Base(root), root
+		if pair := strings.SplitN(root, "=", 2); len(pair) == 2 {
+			name, dir = pair[0], pair[1]
+		}
+		if name == "" || strings.ContainsRune(name, ':') {
+			return nil, fmt.Errorf("Bad media root name %q", name)
+		}
+		if _, ok := v.root(name); ok {
+			return nil, fmt.Errorf("Duplicate media root name %q", name)
+		}
+		resolved, err := realPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		v.roots = append(v.roots, mediaRoot{name: name, dir: resolved})
+	}
+	if exts != "" {
+		for _, ext := range strings.Split(exts, ",") {
+			v.extensions = append(v.extensions, strings.ToLower(strings.TrimPrefix(ext, ".")))
+		}
+	}
+	return v, nil
+}
+
+func (v *fileValidator) root(name string) (mediaRoot, bool) {
+	for _, r := range v.roots {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return mediaRoot{}, false
+}
+
+// Resolve turns a file item's data into the real path of its file, expanding any
+// name:relative/path media root reference and following symlinks.
+// Returns why the file can't be used if it can't, in which case path is meaningless.
+func (v *fileValidator) Resolve(data string) (path string, reason string) {
+	path = data
+	if pair := strings.SplitN(data, ":", 2); len(pair) == 2 {
+		if r, ok := v.root(pair[0]); ok {
+			path = filepath.Join(r.dir, filepath.FromSlash(pair[1]))
+		}
+	}
+
+	path, err := realPath(path)
+	if os.IsNotExist(err) {
+		return "", FileMissing
+	} else if err != nil {
+		return "", FileUnreadable
+	}
+	if len(v.roots) > 0 && !v.inRoots(path) {
+		return "", FileOutsideRoots
+	}
+	return path, ""
+}
+
+// Validate checks the file referred to by a file item's data can be used.
+// Returns why not if it can't, or "" if it can.
+func (v *fileValidator) Validate(data string) string {
+	path, reason := v.Resolve(data)
+	if reason != "" {
+		return reason
+	}
+	if !v.allowedType(path) {
+		return FileBadType
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return FileMissing
+	} else if err != nil {
+		return FileUnreadable
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		return FileUnreadable
+	}
+	return ""
+}
+
+// Whether path has one of the allowed extensions.
+func (v *fileValidator) allowedType(path string) bool {
+	if len(v.extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	return containsString(v.extensions, ext)
+}
+
+// Makes path absolute, with symlinks resolved, so it can be compared with the roots and handed to the
+// downstream service, whatever its working directory.
+func realPath(path string) (string, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// Whether path, which must be a realPath, is inside one of the roots.
+func (v *fileValidator) inRoots(path string) bool {
+	for _, r := range v.roots {
+		rel, err := filepath.Rel(r.dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Recheck validates the data of each file item (keyed by item hash), sending the outcomes down resCh.
+// Meant to be run in its own goroutine, so a slow disk doesn't hold up the hub.
+func (v *fileValidator) Recheck(datas map[string]string, resCh chan<- fileResult) {
+	for hash, data := range datas {
+		res := fileResult{hash: hash, data: data, fileError: v.Validate(data), recheck: true}
+		if res.fileError == "" {
+			path, _ := v.Resolve(data)
+			res.stamp = stampFile(path)
+		}
+		resCh <- res
+	}
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	music := filepath.Join(dir, "music")
+	if err = os.Mkdir(music, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rasputin.mp3", "mabaker.FLAC", "notes.txt", filepath.Join("..", "secret.mp3")} {
+		if err = ioutil.WriteFile(filepath.Join(music, name), []byte("ra ra"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(filepath.Join(dir, "secret.mp3"), filepath.Join(music, "escape.mp3")); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relMusic, err := filepath.Rel(cwd, music)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		roots []string
+		exts  string
+		data  string
+		want  string
+	}{
+		// Test no restrictions
+		{nil, "", filepath.Join(music, "notes.txt"), ""},
+		{nil, "", filepath.Join(music, "gotta-go-fast.mp3"), FileMissing},
+		{nil, "", music, FileUnreadable},
+		// Test extensions
+		{nil, "mp3,.flac", filepath.Join(music, "rasputin.mp3"), ""},
+		{nil, "mp3,.flac", filepath.Join(music, "mabaker.FLAC"), ""},
+		{nil, "mp3,.flac", filepath.Join(music, "notes.txt"), FileBadType},
+		// Test roots
+		{[]string{music}, "", filepath.Join(music, "rasputin.mp3"), ""},
+		{[]string{music}, "", filepath.Join(music, "..", "music", "rasputin.mp3"), ""},
+		{[]string{music}, "", filepath.Join(dir, "secret.mp3"), FileOutsideRoots},
+		{[]string{music}, "", filepath.Join(music, "escape.mp3"), FileOutsideRoots},
+		{[]string{"/"}, "", filepath.Join(music, "rasputin.mp3"), ""},
+		{[]string{relMusic}, "", filepath.Join(music, "rasputin.mp3"), ""},
+		{[]string{relMusic}, "", filepath.Join(dir, "secret.mp3"), FileOutsideRoots},
+		{[]string{music}, "", relMusic + string(filepath.Separator) + "rasputin.mp3", ""},
+		// Test root references
+		{[]string{music}, "", "music:rasputin.mp3", ""},
+		{[]string{"library=" + music}, "", "library:rasputin.mp3", ""},
+		{[]string{"library=" + music}, "", "library:../secret.mp3", FileOutsideRoots},
+		{[]string{"library=" + music}, "", "library:escape.mp3", FileOutsideRoots},
+		{[]string{"library=" + music}, "", "jukebox:rasputin.mp3", FileMissing},
+	}
+
+	for caseno, c := range cases {
+		v, err := newFileValidator(c.roots, c.exts)
+		if err != nil {
+			t.Fatalf("TestValidate: case %d returned err making validator (%s)", caseno, err.Error())
+		}
+		if got := v.Validate(c.data); got != c.want {
+			t.Errorf("TestValidate: case %d gave %q, want %q", caseno, got, c.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "rasputin.mp3")
+	if err = ioutil.WriteFile(want, []byte("ra ra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := newFileValidator([]string{"library=" + dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, reason := v.Resolve("library:rasputin.mp3"); got != want || reason != "" {
+		t.Errorf("TestResolve: gave (%q, %q), want (%q, \"\")", got, reason, want)
+	}
+
+	// Test bad configuration
+	if _, err = newFileValidator([]string{"library=" + dir, "library=" + dir}, ""); err == nil {
+		t.Errorf("TestResolve: duplicate root names returned nil when should be err")
+	}
+	if _, err = newFileValidator([]string{"library=" + filepath.Join(dir, "nope")}, ""); err == nil {
+		t.Errorf("TestResolve: missing root returned nil when should be err")
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rasputin.mp3")
+	if err = ioutil.WriteFile(path, []byte("ra ra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := newFileValidator(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resCh := make(chan fileResult, 2)
+	v.Recheck(map[string]string{"aaa": path, "bbb": filepath.Join(dir, "nope.mp3")}, resCh)
+	for i := 0; i < 2; i++ {
+		res := <-resCh
+		if !res.recheck {
+			t.Errorf("TestRecheck: result for %q not marked as a recheck", res.hash)
+		}
+		switch res.hash {
+		case "aaa":
+			if res.fileError != "" || !res.stamp.same(stampFile(path)) {
+				t.Errorf("TestRecheck: result for aaa == %v, want no error and the file's stamp", res)
+			}
+		case "bbb":
+			if res.fileError != FileMissing {
+				t.Errorf("TestRecheck: result for bbb gave %q, want %q", res.fileError, FileMissing)
+			}
+		}
+	}
+
+	// Test the stamp changes with the file
+	old := stampFile(path)
+	if err = ioutil.WriteFile(path, []byte("lover of the russian queen"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if old.same(stampFile(path)) {
+		t.Errorf("TestRecheck: stamp unchanged after the file changed")
+	}
+}